@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/awsclient"
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/k8sclient"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Number of records kept in the audit ConfigMap unless
+// AWS_SGMANAGER_AUDIT_CONFIGMAP_SIZE says otherwise.
+const defaultAuditConfigMapSize = 100
+
+// Key of the audit ConfigMap holding the records.
+const auditConfigMapKey = "audit.jsonl"
+
+// An AuditSink keeping the most recent records in a ConfigMap.
+type configMapAuditSink struct {
+	clientset *kubernetes.Clientset
+	namespace string
+	name      string
+	size      int
+}
+
+func (c *configMapAuditSink) WriteAuditRecord(ctx context.Context, record *awsclient.AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Error encoding audit record: %w", err)
+	}
+
+	return k8sclient.AppendToConfigMap(ctx, c.clientset, c.namespace, c.name, auditConfigMapKey, string(line), c.size)
+}
+
+// Set up the audit sinks configured through the environment.
+// AWS_SGMANAGER_AUDIT_LOG is the path of a JSON Lines file and
+// AWS_SGMANAGER_AUDIT_CONFIGMAP the name of a ConfigMap in POD_NAMESPACE.
+func auditSinksFromEnv(k8sClient *kubernetes.Clientset) ([]awsclient.AuditSink, error) {
+	sinks := make([]awsclient.AuditSink, 0)
+
+	if path := os.Getenv("AWS_SGMANAGER_AUDIT_LOG"); path != "" {
+		sink, err := awsclient.NewFileAuditSink(path)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if name := os.Getenv("AWS_SGMANAGER_AUDIT_CONFIGMAP"); name != "" {
+		namespace := os.Getenv("POD_NAMESPACE")
+		if namespace == "" {
+			return nil, fmt.Errorf("Env var POD_NAMESPACE must be set to use AWS_SGMANAGER_AUDIT_CONFIGMAP")
+		}
+
+		size := defaultAuditConfigMapSize
+		if value := os.Getenv("AWS_SGMANAGER_AUDIT_CONFIGMAP_SIZE"); value != "" {
+			var err error
+			size, err = strconv.Atoi(value)
+			if err != nil || size < 1 {
+				return nil, fmt.Errorf("Invalid AWS_SGMANAGER_AUDIT_CONFIGMAP_SIZE value: %s", value)
+			}
+		}
+
+		sinks = append(sinks, &configMapAuditSink{clientset: k8sClient, namespace: namespace, name: name, size: size})
+	}
+
+	return sinks, nil
+}
+
+// Keeps track of the nodes seen by the previous reconcile, so that the audit
+// log can say which node changes led to a mutation.
+type nodeTracker struct {
+	known map[string]string
+}
+
+// Describe how the nodes changed since the last call.
+func (n *nodeTracker) changes(addressList []*k8sclient.NameAddressPair) []string {
+	current := make(map[string]string)
+	for _, pair := range addressList {
+		current[pair.Name+" "+pair.Address] = pair.Name
+	}
+
+	results := make([]string, 0)
+	if n.known == nil {
+		results = append(results, fmt.Sprintf("startup with %d node addresses", len(current)))
+	} else {
+		for key := range current {
+			if _, ok := n.known[key]; !ok {
+				results = append(results, "node added: "+key)
+			}
+		}
+		for key := range n.known {
+			if _, ok := current[key]; !ok {
+				results = append(results, "node removed: "+key)
+			}
+		}
+		sort.Strings(results)
+	}
+	if len(results) == 0 {
+		results = append(results, "no node changes")
+	}
+
+	n.known = current
+	return results
+}
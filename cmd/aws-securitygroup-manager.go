@@ -1,17 +1,28 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/trigger-happy/aws-securitygroup-manager/pkg/awsclient"
 	"github.com/trigger-happy/aws-securitygroup-manager/pkg/k8sclient"
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/metrics"
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/schedule"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
-// Delay between runs of the main business logic.
-const sleepTimeSeconds = 60
+// How long an in-flight reconcile is given to finish once a shutdown signal
+// has been received.
+const shutdownGracePeriod = 30 * time.Second
 
 // Additional parameters for firewall entries
 // There are more, but they're declared in the awsclient package
@@ -21,6 +32,14 @@ type EntryParams struct {
 	ToPort   int64
 	IP       string
 	Protocol string
+
+	// If non-zero, node addresses are aggregated into CIDRs no wider than
+	// this prefix length.
+	AggregatePrefixLength int
+
+	// Where to derive OwnerID from when it isn't set directly, one of the
+	// ownerIDFrom constants.
+	OwnerIDFrom string
 }
 
 // Load the env vars into an EntryParams object.
@@ -29,7 +48,6 @@ func getEntryParams() (*EntryParams, error) {
 	var err error
 
 	envVars := []string{
-		"AWS_SGMANAGER_OWNER_ID",
 		"FROM_PORT",
 		"TO_PORT",
 		"PROTOCOL",
@@ -42,7 +60,13 @@ func getEntryParams() (*EntryParams, error) {
 		}
 	}
 
+	// the owner ID may also be derived from the cluster later on, see
+	// resolveOwnerID
 	params.OwnerID = os.Getenv("AWS_SGMANAGER_OWNER_ID")
+	params.OwnerIDFrom = os.Getenv("AWS_SGMANAGER_OWNER_ID_FROM")
+	if (params.OwnerID == "") == (params.OwnerIDFrom == "") {
+		return nil, fmt.Errorf("Exactly one of AWS_SGMANAGER_OWNER_ID and AWS_SGMANAGER_OWNER_ID_FROM must be set")
+	}
 	params.Protocol = os.Getenv("PROTOCOL")
 
 	params.FromPort, err = strconv.ParseInt(os.Getenv("FROM_PORT"), 10, 64)
@@ -51,6 +75,13 @@ func getEntryParams() (*EntryParams, error) {
 	params.ToPort, err = strconv.ParseInt(os.Getenv("TO_PORT"), 10, 64)
 	bailOnError(err)
 
+	if value := os.Getenv("AWS_SGMANAGER_AGGREGATE_PREFIX_LENGTH"); value != "" {
+		params.AggregatePrefixLength, err = strconv.Atoi(value)
+		if err != nil || params.AggregatePrefixLength < 1 || params.AggregatePrefixLength > 32 {
+			return nil, fmt.Errorf("Invalid AWS_SGMANAGER_AGGREGATE_PREFIX_LENGTH value: %s", value)
+		}
+	}
+
 	return &params, nil
 }
 
@@ -69,6 +100,10 @@ func ruleEntriesFromAddressPairs(nap []*k8sclient.NameAddressPair, entryParams *
 		results = append(results, &ruleEntry)
 	}
 
+	if entryParams.AggregatePrefixLength > 0 {
+		results = awsclient.AggregateEntries(results, entryParams.AggregatePrefixLength)
+	}
+
 	return results
 }
 
@@ -81,33 +116,331 @@ func bailOnError(err error) {
 	os.Exit(1)
 }
 
+// Cancel the returned context when SIGTERM or SIGINT is received.
+func contextWithSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		fmt.Printf("Received %s, shutting down\n", sig)
+		cancel()
+	}()
+
+	return ctx
+}
+
+// Create a context that is only cancelled once the grace period has elapsed
+// after the parent is done. This lets a reconcile that is already talking to
+// AWS finish instead of being cut off between a revoke and an authorize.
+func withGracePeriod(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// Like context.WithTimeout, except that a timeout of 0 means none.
+func withOptionalTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+
+	return context.WithTimeout(parent, timeout)
+}
+
+// Check whether err comes from an AWS or Kubernetes call running out of time.
+func isTimeout(err error) bool {
+	return awsclient.IsTimeout(err) || k8sclient.IsTimeout(err)
+}
+
+// Run a single pass of the main business logic against every target. Each
+// region is reconciled in its own goroutine so that an outage in one region
+// doesn't hold up the others. Failures of individual targets are logged and
+// retried on the next pass instead of stopping the whole manager.
+func reconcile(ctx context.Context, k8sClient *kubernetes.Clientset, targets []*awsclient.AwsContext, entryParams *EntryParams, nodes *nodeTracker) error {
+	fmt.Println("Getting list of node names and addresses")
+	addressList, err := k8sclient.GetIPAddressList(ctx, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	ctx = awsclient.WithAuditTriggers(ctx, nodes.changes(addressList))
+
+	ruleEntries := ruleEntriesFromAddressPairs(addressList, entryParams)
+
+	var wg sync.WaitGroup
+	for region, regionTargets := range awsclient.GroupByRegion(targets) {
+		wg.Add(1)
+		go func(region string, regionTargets []*awsclient.AwsContext) {
+			defer wg.Done()
+			reconcileRegion(ctx, k8sClient, region, regionTargets, func(ctx context.Context, aws *awsclient.AwsContext) error {
+				return aws.ReplaceOwnedEntries(ctx, ruleEntries)
+			})
+		}(region, regionTargets)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// Reconcile the targets of a single region one after the other through
+// replace. A failing target doesn't stop the ones after it.
+func reconcileRegion(ctx context.Context, k8sClient *kubernetes.Clientset, region string, targets []*awsclient.AwsContext,
+	replace func(ctx context.Context, aws *awsclient.AwsContext) error) {
+	for _, aws := range targets {
+		fmt.Printf("Replacing rules in %s owned by this instance\n", aws.Target)
+		err := replace(ctx, aws)
+
+		var blocked *awsclient.BlockedChangeError
+		if errors.As(err, &blocked) {
+			fmt.Printf("Warning: %s\n", blocked)
+			metrics.BlockedChanges.WithLabelValues(blocked.Target.String(), blocked.Reason).Inc()
+			k8sclient.RecordEvent(ctx, k8sClient, corev1.EventTypeWarning, "ChangeBlocked", blocked.Error())
+			continue
+		}
+
+		var conflict *awsclient.OwnerConflictError
+		if errors.As(err, &conflict) {
+			fmt.Printf("ERROR: %s\n", conflict)
+			metrics.OwnerConflicts.WithLabelValues(conflict.Target.String()).Inc()
+			k8sclient.RecordEvent(ctx, k8sClient, corev1.EventTypeWarning, "OwnerConflict", conflict.Error())
+		} else if isTimeout(err) {
+			fmt.Printf("Timeout: reconcile of %s in %s ran out of time: %s\n", aws.Target, region, err)
+		} else if err != nil {
+			fmt.Printf("Reconcile of %s in %s failed: %s\n", aws.Target, region, err)
+		}
+	}
+}
+
+// Create an AwsContext for every configured target and log the identity each
+// of them ends up using.
+func initTargets(ctx context.Context, k8sClient *kubernetes.Clientset, entryParams *EntryParams, timeouts awsclient.TimeoutConfig) ([]*awsclient.AwsContext, error) {
+	err := awsclient.CheckRequiredEnvVars()
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := awsclient.TargetsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := awsclient.NewSessionCache(awsclient.AssumeRoleConfigFromEnv())
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimit, err := awsclient.RateLimitConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	sessions.LimitRate(rateLimit)
+	sessions.LimitCallDuration(timeouts.Call)
+
+	quota, err := awsclient.QuotaConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	ownership, err := awsclient.OwnershipModeFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	tagsMigrationUntil, err := awsclient.TagsMigrationFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	signing, err := awsclient.SigningConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	safety, err := awsclient.SafetyConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	auditSinks, err := auditSinksFromEnv(k8sClient)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := snapshotStoreFromEnv(k8sClient)
+	if err != nil {
+		return nil, err
+	}
+
+	conflictWindow, err := awsclient.ConflictWindowFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	adopt, err := awsclient.AdoptFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize, err := awsclient.BatchSizeFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	instanceID, err := k8sclient.GetClusterUID(ctx, k8sClient)
+	if err != nil {
+		fmt.Printf("Warning: not checking for other instances using the same owner ID: %s\n", err)
+	}
+
+	results := make([]*awsclient.AwsContext, 0)
+	for _, target := range targets {
+		aws := awsclient.NewAwsContext(sessions, target, entryParams.OwnerID)
+		aws.Quota = quota
+		aws.Ownership = ownership
+		aws.TagsMigrationUntil = tagsMigrationUntil
+		aws.Signing = signing
+		aws.Safety = safety
+		aws.AuditSinks = auditSinks
+		aws.Snapshots = snapshots
+		aws.InstanceID = instanceID
+		aws.ConflictWindow = conflictWindow
+		aws.Adopt = adopt
+		aws.BatchSize = batchSize
+
+		// an outage in the region of one target mustn't keep the others
+		// from being managed, and every reconcile retries this target
+		identity, err := aws.CallerIdentity(ctx)
+		if err != nil {
+			fmt.Printf("Warning: couldn't check the AWS identity for %s, retrying on every reconcile: %s\n", target, err)
+		} else {
+			fmt.Printf("Using AWS identity %s for %s\n", identity, target)
+		}
+
+		results = append(results, aws)
+	}
+
+	return results, nil
+}
+
 func main() {
+	ctx := contextWithSignals()
+
 	fmt.Println("Reading env vars")
 	entryParams, err := getEntryParams()
 	bailOnError(err)
 
+	timeouts, err := awsclient.TimeoutConfigFromEnv()
+	bailOnError(err)
+	k8sclient.CallTimeout = timeouts.Call
+
 	fmt.Println("Initializing kubernetes client")
 	k8sClient, err := k8sclient.GetKubeClient()
 	bailOnError(err)
 
-	fmt.Println("Initializing AWS client")
-	var aws awsclient.AwsContext
-	err = aws.Init()
+	err = resolveOwnerID(ctx, k8sClient, entryParams)
+	bailOnError(err)
+
+	fmt.Println("Initializing AWS clients")
+	targets, err := initTargets(ctx, k8sClient, entryParams, timeouts)
 	bailOnError(err)
 
-	for true {
-		fmt.Println("Getting list of node names and addresses")
-		addressList, err := k8sclient.GetIPAddressList(k8sClient)
+	args := flag.Args()
+	switch {
+	case len(args) == 0:
+		sched, err := schedule.FromEnv()
 		bailOnError(err)
+		runLoop(ctx, k8sClient, targets, entryParams, timeouts.Reconcile, sched)
+	case len(args) == 2 && args[0] == "plan":
+		bailOnError(runPlan(ctx, k8sClient, targets, entryParams, args[1]))
+	case len(args) == 2 && args[0] == "apply":
+		bailOnError(runApply(ctx, targets, entryParams, args[1]))
+	case len(args) == 2 && args[0] == "restore":
+		bailOnError(runRestore(ctx, k8sClient, targets, args[1]))
+	case len(args) == 2 && args[0] == "migrate-owner":
+		bailOnError(runMigrateOwner(ctx, targets, args[1]))
+	case len(args) >= 2 && args[0] == "transfer":
+		bailOnError(runTransfer(ctx, targets, args[1], args[2:]))
+	case len(args) == 1 && args[0] == "orphans":
+		bailOnError(runOrphans(ctx, targets, false, ""))
+	case len(args) == 2 && args[0] == "orphans" && args[1] == "delete":
+		bailOnError(runOrphans(ctx, targets, true, ""))
+	case len(args) == 3 && args[0] == "orphans" && args[1] == "delete":
+		bailOnError(runOrphans(ctx, targets, true, args[2]))
+	default:
+		bailOnError(fmt.Errorf("Usage: %s [plan <planfile> | apply <planfile> | restore <snapshot> | orphans [delete [<owner>]] | migrate-owner <old-owner> | transfer <new-owner> [<cidr>...]]", os.Args[0]))
+	}
+}
 
-		ruleEntries := ruleEntriesFromAddressPairs(addressList, entryParams)
+// Reconcile right away and then whenever sched says so, until a shutdown
+// signal is received. A reconcile still running after reconcileTimeout is cut
+// off and the remaining work is left to the next one. Reconciles during a
+// maintenance window only add rules.
+func runLoop(ctx context.Context, k8sClient *kubernetes.Clientset, targets []*awsclient.AwsContext, entryParams *EntryParams,
+	reconcileTimeout time.Duration, sched *schedule.Schedule) {
+	metrics.ServeFromEnv()
 
-		fmt.Println("Replacing rules in AWS owned by this instance")
-		err = aws.ReplaceOwnedEntries(ruleEntries)
-		bailOnError(err)
+	delay := sched.InitialDelay()
+	fmt.Printf("Waiting %s before the first reconcile\n", delay)
+	select {
+	case <-ctx.Done():
+		fmt.Println("Shutdown complete")
+		return
+	case <-time.After(delay):
+	}
 
-		fmt.Println("Done, going to sleep")
+	var nodes nodeTracker
+	for {
+		graceCtx, cancelGrace := withGracePeriod(ctx, shutdownGracePeriod)
+		reconcileCtx, cancel := withOptionalTimeout(graceCtx, reconcileTimeout)
+		if window := sched.MaintenanceWindow(time.Now()); window != nil {
+			fmt.Printf("In maintenance window %s, not removing any rules\n", window)
+			reconcileCtx = awsclient.WithRemovalsDeferred(reconcileCtx)
+		}
+		err := reconcile(reconcileCtx, k8sClient, targets, entryParams, &nodes)
+		timedOut := reconcileCtx.Err() == context.DeadlineExceeded
+		cancel()
+		cancelGrace()
+		if ctx.Err() != nil {
+			if err != nil {
+				fmt.Printf("Reconcile interrupted by shutdown: %s\n", err)
+			}
+			fmt.Println("Shutdown complete")
+			return
+		}
+
+		if timedOut {
+			fmt.Printf("Timeout: reconcile didn't complete within %s\n", reconcileTimeout)
+			metrics.Timeouts.WithLabelValues("reconcile", "reconcile").Inc()
+		} else if isTimeout(err) {
+			fmt.Printf("Reconcile failed, retrying on the next pass: %s\n", err)
+		} else {
+			bailOnError(err)
+		}
 
-		time.Sleep(sleepTimeSeconds * time.Second)
+		next := sched.Next(time.Now())
+		fmt.Printf("Done, going to sleep until %s\n", next.Format(time.RFC3339))
+
+		select {
+		case <-ctx.Done():
+			fmt.Println("Shutdown complete")
+			return
+		case <-time.After(time.Until(next)):
+		}
 	}
 }
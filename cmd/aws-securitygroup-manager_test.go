@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/awsclient"
+)
+
+func TestReconcileRegion(t *testing.T) {
+	// events are only logged without a pod to record them against
+	defer os.Setenv("POD_NAME", os.Getenv("POD_NAME"))
+	os.Unsetenv("POD_NAME")
+
+	targets := []*awsclient.AwsContext{
+		&awsclient.AwsContext{Target: awsclient.Target{SecurityGroupID: "sg-1", Region: "eu-west-1"}},
+		&awsclient.AwsContext{Target: awsclient.Target{SecurityGroupID: "sg-2", Region: "eu-west-1"}},
+		&awsclient.AwsContext{Target: awsclient.Target{SecurityGroupID: "sg-3", Region: "eu-west-1"}},
+	}
+
+	replaced := make([]string, 0)
+	reconcileRegion(context.Background(), nil, "eu-west-1", targets, func(ctx context.Context, aws *awsclient.AwsContext) error {
+		replaced = append(replaced, aws.Target.SecurityGroupID)
+		switch aws.Target.SecurityGroupID {
+		case "sg-1":
+			return errors.New("RequestError: send request failed")
+		case "sg-2":
+			return &awsclient.BlockedChangeError{Target: aws.Target, Reason: "shrink"}
+		}
+		return nil
+	})
+
+	if len(replaced) != 3 {
+		t.Errorf("Expected every target to be reconciled despite failures, got %v", replaced)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/awsclient"
+)
+
+// Report the owners that have rules in each security group target and
+// whether their heartbeat is still current. With remove set, the rules of
+// owners whose heartbeat expired are removed, or only the rules of onlyOwner
+// if given, whatever its heartbeat says.
+func runOrphans(ctx context.Context, targets []*awsclient.AwsContext, remove bool, onlyOwner string) error {
+	ttl, err := awsclient.HeartbeatTTLFromEnv()
+	if err != nil {
+		return err
+	}
+
+	for _, aws := range targets {
+		if aws.Target.PrefixListID != "" {
+			fmt.Printf("Skipping %s, prefix lists don't have heartbeats\n", aws.Target)
+			continue
+		}
+
+		reports, err := aws.ScanOwners(ctx, ttl)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s:\n", aws.Target)
+		for _, report := range reports {
+			lastHeartbeat := "never"
+			if !report.LastHeartbeat.IsZero() {
+				lastHeartbeat = report.LastHeartbeat.Format("2006-01-02T15:04:05Z07:00")
+			}
+			fmt.Printf("  %s: %s, %d rules, last heartbeat %s\n", report.OwnerID, report.State, report.RuleCount(), lastHeartbeat)
+		}
+
+		if !remove {
+			continue
+		}
+
+		for _, report := range reports {
+			if onlyOwner != "" && report.OwnerID != onlyOwner {
+				continue
+			}
+			if onlyOwner == "" && report.State != awsclient.OwnerExpired {
+				continue
+			}
+
+			fmt.Printf("Removing %d rules of %s from %s\n", report.RuleCount(), report.OwnerID, aws.Target)
+			ctx := awsclient.WithAuditTriggers(ctx, []string{"orphans delete " + report.OwnerID})
+			err = aws.DeleteOwnerRules(ctx, report)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
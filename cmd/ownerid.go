@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/awsclient"
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/k8sclient"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Ways of deriving the owner ID from the cluster the manager runs in.
+const (
+	// The UID of the kube-system namespace.
+	ownerIDFromClusterUID = "cluster-uid"
+
+	// The AWS account of the manager's own credentials and the name in
+	// AWS_SGMANAGER_EKS_CLUSTER_NAME.
+	ownerIDFromEKS = "eks"
+)
+
+// Fill in the owner ID from the cluster if AWS_SGMANAGER_OWNER_ID_FROM asks
+// for it. The result is the same every time for the same cluster.
+func resolveOwnerID(ctx context.Context, k8sClient *kubernetes.Clientset, entryParams *EntryParams) error {
+	switch entryParams.OwnerIDFrom {
+	case "":
+		return nil
+	case ownerIDFromClusterUID:
+		uid, err := k8sclient.GetClusterUID(ctx, k8sClient)
+		if err != nil {
+			return err
+		}
+		entryParams.OwnerID = awsclient.ClusterOwnerID(uid)
+	case ownerIDFromEKS:
+		clusterName := os.Getenv("AWS_SGMANAGER_EKS_CLUSTER_NAME")
+		if clusterName == "" {
+			return fmt.Errorf("Env var AWS_SGMANAGER_EKS_CLUSTER_NAME must be set when AWS_SGMANAGER_OWNER_ID_FROM is %s", ownerIDFromEKS)
+		}
+
+		accountID, err := awsclient.DefaultAccountID(ctx)
+		if err != nil {
+			return err
+		}
+		entryParams.OwnerID = awsclient.EKSOwnerID(accountID, clusterName)
+	default:
+		return fmt.Errorf("Invalid AWS_SGMANAGER_OWNER_ID_FROM value: %s", entryParams.OwnerIDFrom)
+	}
+
+	fmt.Printf("Using owner ID %s derived from %s\n", entryParams.OwnerID, entryParams.OwnerIDFrom)
+	return nil
+}
+
+// Hand the entries of oldOwnerID in every target over to the current owner
+// ID, without removing any rule. Nothing is changed if any of the targets
+// can't be relabeled in place.
+func runMigrateOwner(ctx context.Context, targets []*awsclient.AwsContext, oldOwnerID string) error {
+	for _, aws := range targets {
+		if err := aws.CheckRelabelable(); err != nil {
+			return fmt.Errorf("%s: %w", aws.Target, err)
+		}
+	}
+
+	ctx = awsclient.WithAuditTriggers(ctx, []string{"migrate-owner " + oldOwnerID})
+	for _, aws := range targets {
+		count, err := aws.RelabelOwnedEntries(ctx, oldOwnerID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", aws.Target, err)
+		}
+
+		fmt.Printf("Moved %d entries in %s from %s to %s\n", count, aws.Target, oldOwnerID, aws.OwnerID)
+	}
+
+	return nil
+}
+
+// Hand the entries of the current owner ID in every target over to
+// newOwnerID, or only the entries for cidrs if given. The rules stay in place
+// throughout. Every target is checked and its owned entries are looked up
+// first. Nothing is moved if any target would refuse the transfer, or if a
+// CIDR matches no entry in any target, since it's most likely a typo.
+func runTransfer(ctx context.Context, targets []*awsclient.AwsContext, newOwnerID string, cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, err := awsclient.NormalizeCIDR(cidr); err != nil {
+			return err
+		}
+	}
+
+	matched := make(map[string]bool)
+	for _, aws := range targets {
+		found, err := aws.TransferableEntries(ctx, newOwnerID, cidrs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", aws.Target, err)
+		}
+
+		for _, cidr := range found {
+			matched[cidr] = true
+		}
+	}
+
+	unmatched := make([]string, 0)
+	for _, cidr := range cidrs {
+		normalized, _ := awsclient.NormalizeCIDR(cidr)
+		if !matched[normalized] {
+			unmatched = append(unmatched, cidr)
+		}
+	}
+	if len(unmatched) > 0 {
+		return fmt.Errorf("No owned entries matched %s, nothing was moved", strings.Join(unmatched, ", "))
+	}
+
+	ctx = awsclient.WithAuditTriggers(ctx, []string{"transfer " + newOwnerID})
+	for _, aws := range targets {
+		moved, err := aws.TransferOwnedEntries(ctx, newOwnerID, cidrs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", aws.Target, err)
+		}
+
+		fmt.Printf("Moved %d entries in %s from %s to %s\n", len(moved), aws.Target, aws.OwnerID, newOwnerID)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/awsclient"
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/k8sclient"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Work out the changes a reconcile would make to every target and save them
+// to path, without changing anything.
+func runPlan(ctx context.Context, k8sClient *kubernetes.Clientset, targets []*awsclient.AwsContext, entryParams *EntryParams, path string) error {
+	fmt.Println("Getting list of node names and addresses")
+	addressList, err := k8sclient.GetIPAddressList(ctx, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	ruleEntries := ruleEntriesFromAddressPairs(addressList, entryParams)
+
+	plan := awsclient.Plan{CreatedAt: time.Now().UTC(), OwnerID: entryParams.OwnerID}
+	for _, aws := range targets {
+		changes, err := aws.PlanChanges(ctx, ruleEntries)
+		if err != nil {
+			return fmt.Errorf("Planning %s failed: %w", aws.Target, err)
+		}
+
+		printChangeSet(changes)
+		plan.Changes = append(plan.Changes, changes)
+	}
+
+	err = awsclient.WritePlan(path, &plan)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Plan saved to %s, run \"apply %s\" to apply it\n", path, path)
+	return nil
+}
+
+// Apply a plan saved by runPlan. Every target is checked against its
+// fingerprint before any of them is changed, so a stale target stops the
+// apply before it starts. Each target is checked once more right before it is
+// changed.
+func runApply(ctx context.Context, targets []*awsclient.AwsContext, entryParams *EntryParams, path string) error {
+	plan, err := awsclient.ReadPlan(path)
+	if err != nil {
+		return err
+	}
+
+	if plan.OwnerID != entryParams.OwnerID {
+		return fmt.Errorf("Plan %s was made for owner %s, not %s", path, plan.OwnerID, entryParams.OwnerID)
+	}
+
+	byTarget := make(map[string]*awsclient.AwsContext)
+	for _, aws := range targets {
+		byTarget[aws.Target.String()] = aws
+	}
+
+	pending := make([]*awsclient.ChangeSet, 0)
+	for _, changes := range plan.Changes {
+		if _, ok := byTarget[changes.Target.String()]; !ok {
+			return fmt.Errorf("Plan %s contains %s, which isn't a configured target", path, changes.Target)
+		}
+		if !changes.Empty() {
+			pending = append(pending, changes)
+		}
+	}
+
+	for _, changes := range pending {
+		err = byTarget[changes.Target.String()].CheckChanges(ctx, changes)
+		if err != nil {
+			return fmt.Errorf("Checking %s failed: %w", changes.Target, err)
+		}
+	}
+
+	ctx = awsclient.WithAuditTriggers(ctx, []string{"apply " + path})
+	for _, changes := range pending {
+		aws := byTarget[changes.Target.String()]
+		printChangeSet(changes)
+		err = aws.ApplyChanges(ctx, changes)
+		if err != nil {
+			return fmt.Errorf("Applying %s failed: %w", changes.Target, err)
+		}
+	}
+
+	fmt.Printf("Applied %d of %d targets from %s\n", len(pending), len(plan.Changes), path)
+	return nil
+}
+
+func printChangeSet(changes *awsclient.ChangeSet) {
+	if changes.Empty() {
+		fmt.Printf("%s: no changes\n", changes.Target)
+		return
+	}
+
+	fmt.Printf("%s:\n", changes.Target)
+	for _, group := range changes.Groups {
+		for _, entry := range group.Authorize {
+			fmt.Printf("  + %s %s %s %d-%d (%s)\n", group.GroupID, entry.IP, entry.Protocol,
+				entry.FromPort, entry.ToPort, entry.NodeName)
+		}
+		for _, entry := range group.Revoke {
+			fmt.Printf("  - %s %s %s %d-%d (%s)\n", group.GroupID, entry.IP, entry.Protocol,
+				entry.FromPort, entry.ToPort, entry.NodeName)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/awsclient"
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/k8sclient"
+	"k8s.io/client-go/kubernetes"
+)
+
+// A SnapshotStore keeping snapshots as keys of a single ConfigMap.
+type configMapSnapshotStore struct {
+	clientset *kubernetes.Clientset
+	namespace string
+	name      string
+	retain    int
+}
+
+func (c *configMapSnapshotStore) SaveSnapshot(ctx context.Context, name string, data []byte) error {
+	return k8sclient.UpdateConfigMap(ctx, c.clientset, c.namespace, c.name, func(configMapData map[string]string) {
+		configMapData[name+".json"] = string(data)
+
+		names := make([]string, 0)
+		for key := range configMapData {
+			names = append(names, strings.TrimSuffix(key, ".json"))
+		}
+		for _, old := range awsclient.SnapshotsToPrune(names, name, c.retain) {
+			delete(configMapData, old+".json")
+		}
+	})
+}
+
+func (c *configMapSnapshotStore) LoadSnapshot(ctx context.Context, name string) ([]byte, error) {
+	data, err := k8sclient.GetConfigMapKey(ctx, c.clientset, c.namespace, c.name, name+".json")
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(data), nil
+}
+
+// Set up the snapshot store configured through the environment, if any.
+// AWS_SGMANAGER_SNAPSHOT_DIR is a local directory and
+// AWS_SGMANAGER_SNAPSHOT_CONFIGMAP the name of a ConfigMap in POD_NAMESPACE.
+func snapshotStoreFromEnv(k8sClient *kubernetes.Clientset) (awsclient.SnapshotStore, error) {
+	dir := os.Getenv("AWS_SGMANAGER_SNAPSHOT_DIR")
+	configMap := os.Getenv("AWS_SGMANAGER_SNAPSHOT_CONFIGMAP")
+	if dir != "" && configMap != "" {
+		return nil, fmt.Errorf("Only one of AWS_SGMANAGER_SNAPSHOT_DIR and AWS_SGMANAGER_SNAPSHOT_CONFIGMAP can be set")
+	}
+
+	retain := awsclient.DefaultSnapshotRetain
+	if value := os.Getenv("AWS_SGMANAGER_SNAPSHOT_RETAIN"); value != "" {
+		var err error
+		retain, err = strconv.Atoi(value)
+		if err != nil || retain < 1 {
+			return nil, fmt.Errorf("Invalid AWS_SGMANAGER_SNAPSHOT_RETAIN value: %s", value)
+		}
+	}
+
+	switch {
+	case dir != "":
+		return &awsclient.DirSnapshotStore{Dir: dir, Retain: retain}, nil
+	case configMap != "":
+		namespace := os.Getenv("POD_NAMESPACE")
+		if namespace == "" {
+			return nil, fmt.Errorf("Env var POD_NAMESPACE must be set to use AWS_SGMANAGER_SNAPSHOT_CONFIGMAP")
+		}
+		return &configMapSnapshotStore{clientset: k8sClient, namespace: namespace, name: configMap, retain: retain}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Bring the target a snapshot was taken of back to the rules in the snapshot.
+func runRestore(ctx context.Context, k8sClient *kubernetes.Clientset, targets []*awsclient.AwsContext, name string) error {
+	store, err := snapshotStoreFromEnv(k8sClient)
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return fmt.Errorf("Set AWS_SGMANAGER_SNAPSHOT_DIR or AWS_SGMANAGER_SNAPSHOT_CONFIGMAP to restore a snapshot")
+	}
+
+	snapshot, err := awsclient.LoadSnapshot(ctx, store, name)
+	if err != nil {
+		return err
+	}
+
+	for _, aws := range targets {
+		if aws.Target.String() != snapshot.Target.String() {
+			continue
+		}
+
+		fmt.Printf("Restoring %s to snapshot %s taken at %s\n", aws.Target, snapshot.Name, snapshot.Time)
+		ctx = awsclient.WithAuditTriggers(ctx, []string{"restore " + snapshot.Name})
+		return aws.RestoreSnapshot(ctx, snapshot)
+	}
+
+	return fmt.Errorf("Snapshot %s was taken of %s, which isn't a configured target", name, snapshot.Target)
+}
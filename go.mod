@@ -3,9 +3,12 @@ module github.com/trigger-happy/aws-securitygroup-manager
 go 1.13
 
 require (
-	github.com/aws/aws-sdk-go v1.29.10
-	k8s.io/api v0.17.2
-	k8s.io/apimachinery v0.17.3
-	k8s.io/client-go v0.17.2
+	github.com/aws/aws-sdk-go v1.44.0
+	github.com/prometheus/client_golang v1.0.0
+	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
+	k8s.io/api v0.18.19
+	k8s.io/apimachinery v0.18.19
+	k8s.io/client-go v0.18.19
 	sigs.k8s.io/controller-runtime v0.5.0
 )
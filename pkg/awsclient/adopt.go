@@ -0,0 +1,128 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Load whether rules without an ownership marker should be adopted from
+// AWS_SGMANAGER_ADOPT.
+func AdoptFromEnv() (bool, error) {
+	value := os.Getenv("AWS_SGMANAGER_ADOPT")
+	if value == "" {
+		return false, nil
+	}
+
+	adopt, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid AWS_SGMANAGER_ADOPT value: %s", value)
+	}
+
+	return adopt, nil
+}
+
+// Take over the rules in the pool that don't carry any ownership marker but
+// match one of entries exactly, by rewriting their markers in place. Rules
+// marked by any owner, including ours, are left alone. Returns whether any
+// rule was adopted.
+func (a *AwsContext) adoptRules(ctx context.Context, pool []*poolGroup, entries []*RuleEntry) (bool, error) {
+	adopted := false
+	wanted := entriesByKey(entries)
+	for _, group := range pool {
+		if group.rules != nil {
+			tags := &tagOwnership{a}
+			for _, rule := range group.rules {
+				entry := adoptableEntry(rule, wanted)
+				if entry == nil {
+					continue
+				}
+
+				fmt.Printf("Adopting rule %s in %s for %s\n", aws.StringValue(rule.SecurityGroupRuleId), group.GroupID, entry)
+				err := tags.updateMarker(ctx, group.GroupID, rule, entry)
+				if err != nil {
+					return adopted, err
+				}
+				adopted = true
+			}
+			continue
+		}
+
+		rules := adoptablePermissions(group.permissions, entries, a.identity())
+		if len(rules) == 0 {
+			continue
+		}
+
+		fmt.Printf("Adopting %d rules in %s\n", len(rules), group.GroupID)
+		err := a.updateRuleDescriptions(ctx, group.GroupID, rules)
+		if err != nil {
+			return adopted, err
+		}
+		adopted = true
+	}
+
+	return adopted, nil
+}
+
+// Index entries by the rule they turn into.
+func entriesByKey(entries []*RuleEntry) map[string]*RuleEntry {
+	results := make(map[string]*RuleEntry)
+	for _, entry := range entries {
+		if _, ok := results[entry.key()]; !ok {
+			results[entry.key()] = entry
+		}
+	}
+
+	return results
+}
+
+// Build the unmarked rules that match one of entries with descriptions
+// marking them as owned by owner, one rule per source.
+func adoptablePermissions(permissions []*ec2.IpPermission, entries []*RuleEntry, owner *ownerIdentity) []*ec2.IpPermission {
+	wanted := entriesByKey(entries)
+	adopted := make([]*RuleEntry, 0)
+	for _, rule := range expandRules(permissions) {
+		source := ruleSourceOf(rule)
+		if source == nil || !source.isCidr() || ParseDescriptionFields(source.Description) != nil {
+			continue
+		}
+
+		if entry, ok := wanted[permissionKey(rule)]; ok {
+			adopted = append(adopted, entry)
+		}
+	}
+
+	return ruleEntriesToIpPermissions(adopted, owner.descriptionFor)
+}
+
+// Find the entry an unmarked security group rule matches among the wanted
+// entries by key, if any.
+func adoptableEntry(rule *ec2.SecurityGroupRule, wanted map[string]*RuleEntry) *RuleEntry {
+	if ruleOwnerID(rule) != "" {
+		return nil
+	}
+
+	return wanted[securityGroupRuleKey(rule)]
+}
+
+// Get the CIDRs of the unmarked prefix list entries that match one of
+// entries.
+func unmarkedPrefixListEntries(current []*ec2.PrefixListEntry, entries []*RuleEntry) []string {
+	wanted := make(map[string]bool)
+	for _, entry := range entries {
+		wanted[entry.IP] = true
+	}
+
+	results := make([]string, 0)
+	for _, entry := range current {
+		if ParseDescriptionFields(entry.Description) == nil && wanted[aws.StringValue(entry.Cidr)] {
+			results = append(results, aws.StringValue(entry.Cidr))
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,97 @@
+package awsclient
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestAdoptablePermissions(t *testing.T) {
+	owner := &ownerIdentity{ID: "owner"}
+	permissions := []*ec2.IpPermission{
+		&ec2.IpPermission{
+			FromPort:   aws.Int64(443),
+			ToPort:     aws.Int64(443),
+			IpProtocol: aws.String("tcp"),
+			IpRanges: []*ec2.IpRange{
+				&ec2.IpRange{CidrIp: aws.String("10.0.0.1/32"), Description: aws.String("node 1, added by hand")},
+				&ec2.IpRange{CidrIp: aws.String("10.0.0.2/32"), Description: aws.String("ownerid=other ; nodename=node2")},
+				&ec2.IpRange{CidrIp: aws.String("10.0.0.3/32")},
+				&ec2.IpRange{CidrIp: aws.String("10.0.0.9/32"), Description: aws.String("office")},
+			},
+		},
+		&ec2.IpPermission{
+			FromPort:   aws.Int64(80),
+			ToPort:     aws.Int64(80),
+			IpProtocol: aws.String("tcp"),
+			IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("10.0.0.3/32")}},
+		},
+	}
+
+	entries := []*RuleEntry{
+		&RuleEntry{OwnerID: "owner", NodeName: "node1", IP: "10.0.0.1/32", FromPort: 443, ToPort: 443, Protocol: "tcp"},
+		&RuleEntry{OwnerID: "owner", NodeName: "node2", IP: "10.0.0.2/32", FromPort: 443, ToPort: 443, Protocol: "tcp"},
+		&RuleEntry{OwnerID: "owner", NodeName: "node3", IP: "10.0.0.3/32", FromPort: 443, ToPort: 443, Protocol: "tcp"},
+	}
+
+	rules := adoptablePermissions(permissions, entries, owner)
+	adopted := make(map[string]string)
+	for _, rule := range rules {
+		adopted[permissionKey(rule)] = ruleDescription(rule)
+	}
+
+	if len(adopted) != 2 {
+		t.Errorf("Expected 2 adopted rules, got %v", adopted)
+	}
+	for _, key := range []string{"tcp/443-443/10.0.0.1/32", "tcp/443-443/10.0.0.3/32"} {
+		description, ok := adopted[key]
+		if !ok || owner.classifyDescription(aws.String(description), &RuleEntry{}) != ruleOwned {
+			t.Errorf("Expected %s to be adopted, got %v", key, adopted)
+		}
+	}
+}
+
+func TestAdoptableEntry(t *testing.T) {
+	entry := &RuleEntry{OwnerID: "owner", NodeName: "node1", IP: "10.0.0.1/32", FromPort: 443, ToPort: 443, Protocol: "tcp"}
+	wanted := entriesByKey([]*RuleEntry{entry})
+
+	unmarked := &ec2.SecurityGroupRule{
+		CidrIpv4:   aws.String("10.0.0.1/32"),
+		FromPort:   aws.Int64(443),
+		ToPort:     aws.Int64(443),
+		IpProtocol: aws.String("tcp"),
+	}
+	if adoptableEntry(unmarked, wanted) != entry {
+		t.Errorf("Expected the unmarked rule to be adopted")
+	}
+
+	tagged := *unmarked
+	tagged.Tags = []*ec2.Tag{&ec2.Tag{Key: aws.String(OwnerTagKey), Value: aws.String("other")}}
+	if adoptableEntry(&tagged, wanted) != nil {
+		t.Errorf("Expected a rule tagged by another owner not to be adopted")
+	}
+
+	otherPort := *unmarked
+	otherPort.FromPort = aws.Int64(80)
+	if adoptableEntry(&otherPort, wanted) != nil {
+		t.Errorf("Expected a rule for other ports not to be adopted")
+	}
+}
+
+func TestUnmarkedPrefixListEntries(t *testing.T) {
+	current := []*ec2.PrefixListEntry{
+		&ec2.PrefixListEntry{Cidr: aws.String("10.0.0.1/32"), Description: aws.String("by hand")},
+		&ec2.PrefixListEntry{Cidr: aws.String("10.0.0.2/32"), Description: aws.String("ownerid=other ; nodename=node2")},
+		&ec2.PrefixListEntry{Cidr: aws.String("10.0.0.9/32")},
+	}
+	entries := []*RuleEntry{
+		&RuleEntry{OwnerID: "owner", NodeName: "node1", IP: "10.0.0.1/32"},
+		&RuleEntry{OwnerID: "owner", NodeName: "node2", IP: "10.0.0.2/32"},
+	}
+
+	results := unmarkedPrefixListEntries(current, entries)
+	if len(results) != 1 || results[0] != "10.0.0.1/32" {
+		t.Errorf("Expected only 10.0.0.1/32 to be reported, got %v", results)
+	}
+}
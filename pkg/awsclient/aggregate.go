@@ -0,0 +1,150 @@
+package awsclient
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Longest list of node names that is written into an aggregated entry. Past
+// this, the list is shortened so the description stays within AWS limits.
+const maxAggregatedNodeNamesLength = 200
+
+// Collapse entries into the smallest set of CIDRs that covers all of them. A
+// resulting CIDR is never wider than maxPrefixLength bits, which bounds how
+// many addresses that don't belong to any node get included. Only entries that
+// agree on owner, protocol and ports are merged. Entries that aren't IPv4 or
+// that are already wider than maxPrefixLength are passed through untouched.
+//
+// The NodeName of an aggregated entry lists the nodes it represents.
+func AggregateEntries(entries []*RuleEntry, maxPrefixLength int) []*RuleEntry {
+	type blockKey struct {
+		owner    string
+		protocol string
+		fromPort int64
+		toPort   int64
+		block    uint32
+	}
+
+	results := make([]*RuleEntry, 0)
+	blocks := make(map[blockKey][]*RuleEntry)
+	order := make([]blockKey, 0)
+	mask := prefixMask(maxPrefixLength)
+
+	for _, entry := range entries {
+		address, ok := aggregatableAddress(entry.IP, maxPrefixLength)
+		if !ok {
+			results = append(results, entry)
+			continue
+		}
+
+		key := blockKey{
+			owner:    entry.OwnerID,
+			protocol: entry.Protocol,
+			fromPort: entry.FromPort,
+			toPort:   entry.ToPort,
+			block:    address & mask,
+		}
+		if _, ok := blocks[key]; !ok {
+			order = append(order, key)
+		}
+		blocks[key] = append(blocks[key], entry)
+	}
+
+	for _, key := range order {
+		results = append(results, mergeBlock(blocks[key]))
+	}
+
+	return results
+}
+
+// Merge the entries of a single block into one entry whose CIDR is the
+// narrowest one that covers all of them.
+func mergeBlock(entries []*RuleEntry) *RuleEntry {
+	if len(entries) == 1 {
+		return entries[0]
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		first, _ := aggregatableAddress(entries[i].IP, 32)
+		second, _ := aggregatableAddress(entries[j].IP, 32)
+		return first < second
+	})
+
+	// the common prefix of the lowest and highest address is shared by
+	// everything in between
+	low, _ := aggregatableAddress(entries[0].IP, 32)
+	high, _ := aggregatableAddress(entries[len(entries)-1].IP, 32)
+	prefixLength := 32
+	for prefixLength > 0 && low&prefixMask(prefixLength) != high&prefixMask(prefixLength) {
+		prefixLength--
+	}
+
+	for _, entry := range entries {
+		_, network, _ := net.ParseCIDR(entry.IP)
+		ones, _ := network.Mask.Size()
+		if ones < prefixLength {
+			prefixLength = ones
+		}
+	}
+
+	nodeNames := make([]string, 0)
+	for _, entry := range entries {
+		nodeNames = append(nodeNames, entry.NodeName)
+	}
+
+	merged := *entries[0]
+	merged.NodeName = joinNodeNames(nodeNames)
+	merged.IP = fmt.Sprintf("%s/%d", uint32ToIP(low&prefixMask(prefixLength)), prefixLength)
+	return &merged
+}
+
+// Join node names for use in an aggregated entry, shortening the list if it
+// would get too long.
+func joinNodeNames(nodeNames []string) string {
+	joined := strings.Join(nodeNames, ",")
+	if len(joined) <= maxAggregatedNodeNamesLength {
+		return joined
+	}
+
+	for count := len(nodeNames) - 1; count > 0; count-- {
+		shortened := fmt.Sprintf("%s,+%d", strings.Join(nodeNames[:count], ","), len(nodeNames)-count)
+		if len(shortened) <= maxAggregatedNodeNamesLength {
+			return shortened
+		}
+	}
+
+	return fmt.Sprintf("%d-nodes", len(nodeNames))
+}
+
+// Parse an IPv4 CIDR that is no wider than maxPrefixLength into the integer
+// form of its address.
+func aggregatableAddress(cidr string, maxPrefixLength int) (uint32, bool) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return 0, false
+	}
+
+	ones, _ := network.Mask.Size()
+	if ones < maxPrefixLength {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(network.IP.To4()), true
+}
+
+func prefixMask(prefixLength int) uint32 {
+	if prefixLength <= 0 {
+		return 0
+	}
+
+	return ^uint32(0) << uint(32-prefixLength)
+}
+
+func uint32ToIP(address uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, address)
+	return ip
+}
@@ -0,0 +1,71 @@
+package awsclient
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAggregateEntries(t *testing.T) {
+	t.Run("Contiguous addresses", func(t *testing.T) {
+		entries := []*RuleEntry{
+			&RuleEntry{NodeName: "node3", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.3/32", Protocol: "tcp"},
+			&RuleEntry{NodeName: "node1", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"},
+			&RuleEntry{NodeName: "node2", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.2/32", Protocol: "tcp"},
+		}
+
+		results := AggregateEntries(entries, 28)
+		if len(results) != 1 {
+			t.Fatalf("Expected 1 entry, got %v", results)
+		}
+		if results[0].IP != "10.0.0.0/30" {
+			t.Errorf("Expected 10.0.0.0/30, got %s", results[0].IP)
+		}
+		if results[0].NodeName != "node1,node2,node3" {
+			t.Errorf("Expected node1,node2,node3, got %s", results[0].NodeName)
+		}
+	})
+
+	t.Run("Never wider than the limit", func(t *testing.T) {
+		entries := []*RuleEntry{
+			&RuleEntry{NodeName: "node1", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"},
+			&RuleEntry{NodeName: "node2", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.17/32", Protocol: "tcp"},
+			&RuleEntry{NodeName: "node3", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.200/32", Protocol: "tcp"},
+		}
+
+		results := AggregateEntries(entries, 28)
+		if len(results) != 3 {
+			t.Fatalf("Expected 3 entries, got %v", results)
+		}
+		for idx, entry := range results {
+			if entry.IP != entries[idx].IP {
+				t.Errorf("Expected %s to be left alone, got %s", entries[idx].IP, entry.IP)
+			}
+		}
+	})
+
+	t.Run("Different ports aren't merged", func(t *testing.T) {
+		other := &RuleEntry{NodeName: "node2", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.2/32", Protocol: "tcp"}
+		other.FromPort = 80
+		other.ToPort = 80
+
+		results := AggregateEntries([]*RuleEntry{&RuleEntry{NodeName: "node1", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"}, other}, 28)
+		if len(results) != 2 {
+			t.Errorf("Expected 2 entries, got %v", results)
+		}
+	})
+
+	t.Run("Long node name lists get shortened", func(t *testing.T) {
+		names := make([]string, 0)
+		for idx := 0; idx < 40; idx++ {
+			names = append(names, "a-rather-long-node-name")
+		}
+
+		joined := joinNodeNames(names)
+		if len(joined) > maxAggregatedNodeNamesLength {
+			t.Errorf("Joined node names are %d characters long", len(joined))
+		}
+		if !strings.HasSuffix(joined, ",+32") {
+			t.Errorf("Expected the count of left out nodes at the end, got %s", joined)
+		}
+	})
+}
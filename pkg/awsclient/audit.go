@@ -0,0 +1,204 @@
+package awsclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Kinds of mutations recorded in the audit log.
+const (
+	AuditAuthorize         = "authorize"
+	AuditRevoke            = "revoke"
+	AuditUpdateDescription = "update-description"
+	AuditUpdateTags        = "update-tags"
+	AuditModifyPrefixList  = "modify-prefix-list"
+	AuditResizePrefixList  = "resize-prefix-list"
+)
+
+// A single mutation made to AWS, successful or not.
+type AuditRecord struct {
+	Time    time.Time `json:"time"`
+	OwnerID string    `json:"ownerId"`
+	Target  string    `json:"target"`
+
+	// The security group or prefix list that was changed.
+	GroupID string `json:"groupId"`
+	Action  string `json:"action"`
+
+	Authorized []string `json:"authorized,omitempty"`
+	Revoked    []string `json:"revoked,omitempty"`
+
+	// What caused the reconcile that made the change, see
+	// WithAuditTriggers.
+	Triggers []string `json:"triggers,omitempty"`
+
+	RequestID string `json:"requestId,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Somewhere audit records are kept. Records are only ever appended.
+type AuditSink interface {
+	WriteAuditRecord(ctx context.Context, record *AuditRecord) error
+}
+
+// An AuditSink appending records to a local file in the JSON Lines format.
+type FileAuditSink struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// Open path for appending audit records, creating it if needed.
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening audit log %s: %w", path, err)
+	}
+
+	return &FileAuditSink{path: path, file: file}, nil
+}
+
+func (f *FileAuditSink) WriteAuditRecord(ctx context.Context, record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Error encoding audit record: %w", err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, err = f.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("Error writing audit log %s: %w", f.path, err)
+	}
+
+	return f.file.Sync()
+}
+
+type auditTriggersKey struct{}
+
+// Attach the events that triggered a reconcile, such as nodes joining or
+// leaving, to ctx. They're recorded with every mutation made using ctx.
+func WithAuditTriggers(ctx context.Context, triggers []string) context.Context {
+	return context.WithValue(ctx, auditTriggersKey{}, triggers)
+}
+
+func auditTriggers(ctx context.Context) []string {
+	triggers, _ := ctx.Value(auditTriggersKey{}).([]string)
+	return triggers
+}
+
+// How long writing the buffered audit records of a call may take. Records
+// are written with their own deadline so that a canceled or timed out
+// reconcile still gets its changes recorded.
+const auditWriteTimeout = 10 * time.Second
+
+type auditBufferKey struct{}
+
+// Audit records held back until the mutating call that made them is done.
+type auditBuffer struct {
+	records []*AuditRecord
+	mutex   sync.Mutex
+}
+
+// Start buffering the audit records of mutations made with the returned ctx.
+// The returned function writes them to the sinks and must be called once the
+// mutations are done. Nested calls share the buffer of the outermost one,
+// which is the only one to write it, so sink writes never sit between the
+// AWS calls of a replacement.
+func (a *AwsContext) bufferAudit(ctx context.Context) (context.Context, func()) {
+	if _, ok := ctx.Value(auditBufferKey{}).(*auditBuffer); ok || len(a.AuditSinks) == 0 {
+		return ctx, func() {}
+	}
+
+	buffer := &auditBuffer{}
+	return context.WithValue(ctx, auditBufferKey{}, buffer), func() {
+		buffer.mutex.Lock()
+		records := buffer.records
+		buffer.records = nil
+		buffer.mutex.Unlock()
+
+		a.writeAuditRecords(records)
+	}
+}
+
+// Record a mutation of groupID in every audit sink. The record is held back
+// if ctx buffers records, see bufferAudit. A sink that fails is logged but
+// doesn't stop the mutation from being reported as done, since it has
+// already happened by then.
+func (a *AwsContext) audit(ctx context.Context, groupID string, action string, authorized []string, revoked []string, requestID string, err error) {
+	if len(a.AuditSinks) == 0 {
+		return
+	}
+
+	record := AuditRecord{
+		Time:       time.Now().UTC(),
+		OwnerID:    a.OwnerID,
+		Target:     a.Target.String(),
+		GroupID:    groupID,
+		Action:     action,
+		Authorized: authorized,
+		Revoked:    revoked,
+		Triggers:   auditTriggers(ctx),
+		RequestID:  requestID,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if buffer, ok := ctx.Value(auditBufferKey{}).(*auditBuffer); ok {
+		buffer.mutex.Lock()
+		buffer.records = append(buffer.records, &record)
+		buffer.mutex.Unlock()
+		return
+	}
+
+	a.writeAuditRecords([]*AuditRecord{&record})
+}
+
+// Write records to every audit sink, independently of the context of the
+// calls that made them.
+func (a *AwsContext) writeAuditRecords(records []*AuditRecord) {
+	if len(records) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+
+	for _, record := range records {
+		for _, sink := range a.AuditSinks {
+			sinkErr := sink.WriteAuditRecord(ctx, record)
+			if sinkErr != nil {
+				fmt.Printf("Warning: couldn't write audit record for %s %s: %s\n", record.Action, record.GroupID, sinkErr)
+			}
+		}
+	}
+}
+
+// A request option storing the AWS request ID of the call in requestID once
+// it completes.
+func captureRequestID(requestID *string) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			*requestID = r.RequestID
+		})
+	}
+}
+
+// Describe rules for the audit log, one string per source.
+func auditRules(rules []*ec2.IpPermission) []string {
+	results := make([]string, 0)
+	for _, rule := range expandRules(rules) {
+		results = append(results, fmt.Sprintf("%s %s", permissionKey(rule), ruleDescription(rule)))
+	}
+
+	return results
+}
@@ -0,0 +1,118 @@
+package awsclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type memoryAuditSink struct {
+	records []*AuditRecord
+}
+
+func (m *memoryAuditSink) WriteAuditRecord(ctx context.Context, record *AuditRecord) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	m.records = append(m.records, record)
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	sink := &memoryAuditSink{}
+	a := AwsContext{OwnerID: "owner", Target: Target{SecurityGroupID: "sg-1"}, AuditSinks: []AuditSink{sink}}
+	ctx := WithAuditTriggers(context.Background(), []string{"node added: node1 10.0.0.1"})
+
+	rules := RuleEntriesToAwsIpPermissions([]*RuleEntry{
+		&RuleEntry{NodeName: "node1", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"},
+	})
+	a.audit(ctx, "sg-1", AuditAuthorize, auditRules(rules), nil, "req-1", errors.New("failed"))
+
+	if len(sink.records) != 1 {
+		t.Fatalf("Expected one record, got %d", len(sink.records))
+	}
+	record := sink.records[0]
+	if record.OwnerID != "owner" || record.GroupID != "sg-1" || record.RequestID != "req-1" || record.Error != "failed" {
+		t.Errorf("Unexpected record %+v", record)
+	}
+	if len(record.Triggers) != 1 || record.Triggers[0] != "node added: node1 10.0.0.1" {
+		t.Errorf("Expected the triggers from the context, got %v", record.Triggers)
+	}
+	expected := "tcp/5432-5432/10.0.0.1/32 sgm/v2 owner=owner node=node1"
+	if len(record.Authorized) != 1 || record.Authorized[0] != expected {
+		t.Errorf("Expected %s to be authorized, got %v", expected, record.Authorized)
+	}
+}
+
+func TestAuditBuffered(t *testing.T) {
+	sink := &memoryAuditSink{}
+	a := AwsContext{OwnerID: "owner", Target: Target{SecurityGroupID: "sg-1"}, AuditSinks: []AuditSink{sink}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, flush := a.bufferAudit(ctx)
+	nested, flushNested := a.bufferAudit(ctx)
+	a.audit(ctx, "sg-1", AuditAuthorize, []string{"added"}, nil, "req-1", nil)
+	a.audit(nested, "sg-1", AuditRevoke, nil, []string{"removed"}, "req-2", nil)
+	flushNested()
+	if len(sink.records) != 0 {
+		t.Fatalf("Expected the records to be held back until the outermost flush, got %d", len(sink.records))
+	}
+
+	// a canceled call still gets its changes recorded
+	cancel()
+	flush()
+	if len(sink.records) != 2 || sink.records[0].Action != AuditAuthorize || sink.records[1].Action != AuditRevoke {
+		t.Errorf("Expected both records in order, got %v", sink.records)
+	}
+
+	flush()
+	if len(sink.records) != 2 {
+		t.Errorf("Expected records to be written only once, got %d", len(sink.records))
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.jsonl")
+	for _, groupID := range []string{"sg-1", "sg-2"} {
+		// reopen every time to make sure existing records are kept
+		sink, err := NewFileAuditSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sink.WriteAuditRecord(context.Background(), &AuditRecord{GroupID: groupID, Action: AuditRevoke})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	groupIDs := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid line '%s': %s", scanner.Text(), err)
+		}
+		groupIDs = append(groupIDs, record.GroupID)
+	}
+
+	if len(groupIDs) != 2 || groupIDs[0] != "sg-1" || groupIDs[1] != "sg-2" {
+		t.Errorf("Expected records for sg-1 and sg-2, got %v", groupIDs)
+	}
+}
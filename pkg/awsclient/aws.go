@@ -1,31 +1,82 @@
 package awsclient
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
-// A bundle of other structs to serve as a context for this connection.
+// A bundle of other structs to serve as a context for this connection. Each
+// AwsContext manages a single security group, using the session of its target.
 type AwsContext struct {
 	session         *session.Session
 	ec2             *ec2.EC2
+	Target          Target
 	SecurityGroupID string
 	OwnerID         string
+	Quota           QuotaConfig
+
+	// How ownership of rules is recorded, either OwnershipDescription or
+	// OwnershipTags. Empty means OwnershipDescription.
+	Ownership string
+
+	// Until when rules without owner tags are judged by their description
+	// marker in the tags mode, so that rules created in the description
+	// mode are taken over and tagged. The zero time disables this.
+	TagsMigrationUntil time.Time
+
+	// How ownership markers are signed, if at all.
+	Signing SigningConfig
+
+	// Limits on how many owned entries a single replacement may remove.
+	Safety SafetyConfig
+
+	// Where every mutation is recorded, if anywhere.
+	AuditSinks []AuditSink
+
+	// Where the rules are saved before they are changed, if anywhere.
+	Snapshots               SnapshotStore
+	lastSnapshotFingerprint string
+
+	// Identifies the cluster this instance runs in, published with the
+	// heartbeat so that another instance using the same owner ID is
+	// noticed. Empty disables the check.
+	InstanceID string
+
+	// How long a heartbeat of another instance blocks changes.
+	ConflictWindow time.Duration
+
+	// Take over unmarked rules that match wanted entries.
+	Adopt bool
+
+	// How many rules a single call changes at most. 0 means the default.
+	BatchSize int
+
+	quotaMutex    sync.Mutex
+	lookedUpQuota int
 }
 
 // This is the equivalent of a firewall inbound rule entry in the AWS security group.
 type RuleEntry struct {
-	NodeName string
-	OwnerID  string
-	FromPort int64
-	ToPort   int64
-	IP       string
-	Protocol string
+	NodeName string `json:"nodeName"`
+	OwnerID  string `json:"ownerId"`
+	FromPort int64  `json:"fromPort"`
+	ToPort   int64  `json:"toPort"`
+	IP       string `json:"ip"`
+	Protocol string `json:"protocol"`
+}
+
+// Identifies the rule an entry turns into, regardless of who owns it.
+func (r *RuleEntry) key() string {
+	return fmt.Sprintf("%s/%d-%d/%s", r.Protocol, r.FromPort, r.ToPort, r.IP)
 }
 
 func (r RuleEntry) String() string {
@@ -35,135 +86,324 @@ func (r RuleEntry) String() string {
 
 // Initialize the connection to the AWS API.
 func (a *AwsContext) Init() error {
-	err := checkEnvVars()
+	err := CheckRequiredEnvVars()
+	if err == nil {
+		err = checkEnvVars("AWS_SGMANAGER_OWNER_ID", "AWS_SECURITY_GROUP_ID")
+	}
 	if err != nil {
 		return fmt.Errorf("Init fail: %w", err)
 	}
 
-	a.session, err = session.NewSession(&aws.Config{})
+	sessions, err := NewSessionCache(AssumeRoleConfigFromEnv())
+	if err != nil {
+		return err
+	}
+
+	a.Quota, err = QuotaConfigFromEnv()
 	if err != nil {
-		return fmt.Errorf("Error initializing AWS Session: %w", err)
+		return fmt.Errorf("Init fail: %w", err)
+	}
+
+	a.Ownership, err = OwnershipModeFromEnv()
+	if err != nil {
+		return fmt.Errorf("Init fail: %w", err)
+	}
+
+	a.TagsMigrationUntil, err = TagsMigrationFromEnv()
+	if err != nil {
+		return fmt.Errorf("Init fail: %w", err)
+	}
+
+	a.Signing, err = SigningConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("Init fail: %w", err)
+	}
+
+	a.Safety, err = SafetyConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("Init fail: %w", err)
+	}
+
+	a.BatchSize, err = BatchSizeFromEnv()
+	if err != nil {
+		return fmt.Errorf("Init fail: %w", err)
 	}
 
-	a.ec2 = ec2.New(a.session)
 	a.SetOwnerIDFromEnv()
 	a.SetSecurityGroupIDFromEnv()
+	a.initTarget(sessions, Target{SecurityGroupID: a.SecurityGroupID})
 
 	return nil
 }
 
+// Create an AwsContext that manages the security group of target on behalf
+// of ownerID.
+func NewAwsContext(sessions *SessionCache, target Target, ownerID string) *AwsContext {
+	var a AwsContext
+	a.OwnerID = ownerID
+	a.initTarget(sessions, target)
+	return &a
+}
+
+func (a *AwsContext) initTarget(sessions *SessionCache, target Target) {
+	if target.Region == "" {
+		target.Region = sessions.DefaultRegion()
+	}
+
+	a.Target = target
+	a.SecurityGroupID = target.SecurityGroupID
+	a.session = sessions.SessionFor(target)
+	a.ec2 = sessions.EC2For(target)
+}
+
+// The region this context's security group lives in.
+func (a *AwsContext) Region() string {
+	return a.Target.Region
+}
+
 // Given the SecurityGroupID in the current context, get the list of firewall
 // entries that are tagged under the current OwnerID.
-func (a *AwsContext) GetOwnedEntries() ([]*RuleEntry, error) {
-	permissions, err := a.GetInboundRulesOwnedByID()
+func (a *AwsContext) GetOwnedEntries(ctx context.Context) ([]*RuleEntry, error) {
+	permissions, err := a.GetInboundRulesOwnedByID(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("GetOwnedEntries error: %w", err)
 	}
 
+	return ruleEntriesFromOwnedRules(permissions), nil
+}
+
+// Convert a list of expanded ec2.IpPermission objects that are known to be
+// owned into RuleEntry objects.
+func ruleEntriesFromOwnedRules(permissions []*ec2.IpPermission) []*RuleEntry {
 	result := make([]*RuleEntry, 0)
-	for _, iprange := range permissions[0].IpRanges {
-		rule := RuleEntryFromDescription(iprange.Description)
-		rule.FromPort = *permissions[0].FromPort
-		rule.ToPort = *permissions[0].ToPort
-		rule.Protocol = *permissions[0].IpProtocol
-		rule.IP = *iprange.CidrIp
+	for _, permission := range permissions {
+		source := ruleSourceOf(permission)
+		if source == nil || !source.isCidr() {
+			continue
+		}
+
+		rule := RuleEntryFromDescription(source.Description)
+		if rule == nil {
+			continue
+		}
+		rule.FromPort = aws.Int64Value(permission.FromPort)
+		rule.ToPort = aws.Int64Value(permission.ToPort)
+		rule.Protocol = aws.StringValue(permission.IpProtocol)
+		rule.IP = source.ID
 		result = append(result, rule)
 	}
 
-	return result, nil
+	return result
 }
 
-// Delete all the firewall entries tagged under the current OwnerID and then
-// add a fresh set of rules according to the entries parameter.
-func (a *AwsContext) ReplaceOwnedEntries(entries []*RuleEntry) error {
-	// Convert from RuleEntry to ec2.IpPermission objects
-	ruleList := make([]*ec2.IpPermission, 0)
-	for _, entry := range entries {
-		var iprange ec2.IpRange
-		description := entry.GetDescription()
-		iprange.CidrIp = &entry.IP
-		iprange.Description = &description
+// Bring the firewall entries tagged under the current OwnerID in line with
+// the entries parameter. New rules are added before stale ones are removed,
+// so that addresses that stay wanted never lose access.
+//
+// The entries are spread over the security group and, if enabled, its pool of
+// overflow groups while keeping each group within its rule quota. If the
+// target is a managed prefix list, that is updated instead.
+//
+// Nothing is changed and a BlockedChangeError is returned if the replacement
+// would remove more owned entries than the Safety settings allow.
+func (a *AwsContext) ReplaceOwnedEntries(ctx context.Context, entries []*RuleEntry) error {
+	ctx, flushAudit := a.bufferAudit(ctx)
+	defer flushAudit()
+
+	if a.Target.PrefixListID != "" {
+		return a.ReplaceOwnedPrefixListEntries(ctx, entries)
+	}
+
+	pool, err := a.getGroupPool(ctx)
+	if err != nil {
+		return fmt.Errorf("ReplaceOwnedEntries error while getting old rules: %w", err)
+	}
 
-		var replacement ec2.IpPermission
-		replacement.FromPort = &entry.FromPort
-		replacement.ToPort = &entry.ToPort
-		replacement.IpProtocol = &entry.Protocol
-		replacement.IpRanges = append(replacement.IpRanges, &iprange)
+	// the heartbeat says this owner is still around, even if the changes
+	// below end up being blocked
+	err = a.claimOwnerID(ctx)
+	if err != nil {
+		return err
+	}
 
-		ruleList = append(ruleList, &replacement)
+	owned := 0
+	for _, group := range pool {
+		owned += len(group.Owned)
+	}
+	err = a.checkSafety(owned, countDistinctEntries(entries))
+	if err != nil {
+		return err
 	}
 
-	// get all the rules in this security group
-	oldRules, err := a.GetInboundRules()
+	err = a.snapshotPool(ctx, pool, false)
 	if err != nil {
-		return fmt.Errorf("ReplaceOwnedEntries error while getting old rules: %w", err)
+		return fmt.Errorf("ReplaceOwnedEntries error while saving a snapshot: %w", err)
 	}
 
-	// expand the rules and then get the ones that we don't own
-	expandedRules := expandRules(oldRules)
-	notMyRules := filterInboundRules(expandedRules, &a.OwnerID, false)
-	a.DeleteInboundRules(oldRules)
+	if a.Adopt {
+		adopted, err := a.adoptRules(ctx, pool, entries)
+		if err != nil {
+			return fmt.Errorf("ReplaceOwnedEntries error while adopting rules: %w", err)
+		}
 
-	// create the new rules list
-	newRules := make([]*ec2.IpPermission, 0)
-	newRules = append(newRules, notMyRules...)
-	newRules = append(newRules, ruleList...)
+		if adopted {
+			pool, err = a.getGroupPool(ctx)
+			if err != nil {
+				return fmt.Errorf("ReplaceOwnedEntries error while getting adopted rules: %w", err)
+			}
+		}
+	}
 
-	// save it
-	return a.SetInboundRules(newRules)
-}
+	unassigned := assignEntries(pool, entries)
+	a.warnOnQuotaUsage(pool)
+	for _, group := range pool {
+		for _, rule := range group.Spoofed {
+			fmt.Printf("Warning: rule %s in %s claims to be ours but its signature is invalid, leaving it alone\n",
+				rule, group.GroupID)
+		}
+	}
 
-// The Description column in an AWS Security Group allows for arbitrary data.
-// We use that here to tag entries for ownership. Anything that is "owned" by
-// the current context is fair game while everything else is left alone.
-const descriptionFormat = "ownerid=%s ; nodename=%s"
+	var result error
+	for _, group := range pool {
+		err = a.ownership().replaceOwnedEntries(ctx, group.groupState, group.Assigned)
+		if err != nil && result == nil {
+			result = err
+		}
+	}
 
-// Create a "Description" according to the OwnerID and NodeName values.
-func (r *RuleEntry) GetDescription() string {
-	return fmt.Sprintf(descriptionFormat, r.OwnerID, r.NodeName)
-}
+	if result != nil {
+		return result
+	}
 
-// Given the string found in the Description column of an inbound rule, get the
-// OwnerID and NodeName out of it.
-func ParseDescription(description *string) (*string, *string) {
-	var ownerid, nodename string
-	_, err := fmt.Sscanf(*description, descriptionFormat, &ownerid, &nodename)
-	if err != nil {
-		return nil, nil
+	if len(unassigned) > 0 {
+		return fmt.Errorf("ReplaceOwnedEntries error: %d entries didn't fit in the rule quota of %s and its overflow groups",
+			len(unassigned), a.SecurityGroupID)
 	}
 
-	return &ownerid, &nodename
+	return nil
 }
 
-// Create a RuleEntry from a Description string. Note that this will only fill up
-// the OwnerID and NodeName fields so the rest will still have to be filled up
-// after.
-func RuleEntryFromDescription(description *string) *RuleEntry {
-	var result RuleEntry
-	_, err := fmt.Sscanf(*description, descriptionFormat, &result.OwnerID, &result.NodeName)
+// Replace the owned entries of a single security group. oldRules is the
+// current set of inbound rules of that group. Only the rules that change are
+// touched: new entries are added first, then the descriptions of kept rules
+// are brought up to date and finally the stale owned rules are removed.
+func (a *AwsContext) replaceOwnedEntriesInGroup(ctx context.Context, groupID string, oldRules []*ec2.IpPermission, entries []*RuleEntry) error {
+	changes := diffOwnedRules(groupID, oldRules, entries, a.identity())
+
+	err := a.setInboundRules(ctx, groupID, a.ruleEntriesToIpPermissions(changes.authorize))
+	if err != nil {
+		return fmt.Errorf("ReplaceOwnedEntries error while adding rules to %s: %w", groupID, err)
+	}
+
+	err = a.updateRuleDescriptions(ctx, groupID, a.ruleEntriesToIpPermissions(changes.describe))
 	if err != nil {
+		return fmt.Errorf("ReplaceOwnedEntries error while updating rules in %s: %w", groupID, err)
+	}
+
+	if a.deferRemovals(ctx, groupID, len(changes.revoke)) {
 		return nil
 	}
 
-	return &result
+	err = a.deleteInboundRules(ctx, groupID, changes.revoke)
+	if err != nil {
+		return fmt.Errorf("ReplaceOwnedEntries error while deleting old rules from %s: %w", groupID, err)
+	}
+
+	return nil
+}
+
+// The changes that bring the owned rules of one group in line with the
+// wanted entries.
+type ownedRuleChanges struct {
+	authorize []*RuleEntry
+	describe  []*RuleEntry
+
+	// Expanded rules exactly as they were read, so that nothing but the
+	// owned rules can match when they are revoked.
+	revoke []*ec2.IpPermission
+}
+
+func diffOwnedRules(groupID string, current []*ec2.IpPermission, entries []*RuleEntry, owner *ownerIdentity) *ownedRuleChanges {
+	var changes ownedRuleChanges
+
+	owned := make(map[string]*ec2.IpPermission)
+	foreign := make(map[string]bool)
+	for _, rule := range expandRules(current) {
+		key := permissionKey(rule)
+		if classifyRule(rule, owner) == ruleOwned {
+			owned[key] = rule
+		} else {
+			foreign[key] = true
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, entry := range entries {
+		key := entry.key()
+		if wanted[key] {
+			continue
+		}
+		wanted[key] = true
+
+		rule, ok := owned[key]
+		if !ok {
+			// AWS refuses to add a rule that only differs from an
+			// existing one by its description
+			if foreign[key] {
+				fmt.Printf("Skipping %s, %s already has a rule for it that isn't ours\n", entry, groupID)
+				continue
+			}
+
+			changes.authorize = append(changes.authorize, entry)
+			continue
+		}
+
+		if ruleDescription(rule) != owner.descriptionFor(entry) {
+			changes.describe = append(changes.describe, entry)
+		}
+	}
+
+	for _, rule := range expandRules(current) {
+		key := permissionKey(rule)
+		if !wanted[key] && classifyRule(rule, owner) == ruleOwned {
+			changes.revoke = append(changes.revoke, rule)
+		}
+	}
+
+	return &changes
 }
 
 // Convert a list of RuleEntry objects into a list ofec2.IpPermission objects.
 func RuleEntriesToAwsIpPermissions(entries []*RuleEntry) []*ec2.IpPermission {
+	return ruleEntriesToIpPermissions(entries, (*RuleEntry).GetDescription)
+}
+
+// Convert a list of RuleEntry objects into a list of ec2.IpPermission objects
+// whose descriptions are signed if signing is enabled.
+func (a *AwsContext) ruleEntriesToIpPermissions(entries []*RuleEntry) []*ec2.IpPermission {
+	return ruleEntriesToIpPermissions(entries, a.identity().descriptionFor)
+}
+
+func ruleEntriesToIpPermissions(entries []*RuleEntry, describe func(*RuleEntry) string) []*ec2.IpPermission {
 	permissions := make([]*ec2.IpPermission, 0)
 
 	for _, entry := range entries {
-		ipranges := make([]*ec2.IpRange, 0)
-		var ipr ec2.IpRange
-		ipr.SetCidrIp(entry.IP)
-		ipr.SetDescription(entry.GetDescription())
-		ipranges = append(ipranges, &ipr)
-
 		var tmpPerm ec2.IpPermission
 		tmpPerm.SetFromPort(entry.FromPort)
 		tmpPerm.SetToPort(entry.ToPort)
 		tmpPerm.SetIpProtocol(entry.Protocol)
-		tmpPerm.SetIpRanges(ipranges)
+
+		if isIPv6Cidr(entry.IP) {
+			var ipr ec2.Ipv6Range
+			ipr.SetCidrIpv6(entry.IP)
+			ipr.SetDescription(describe(entry))
+			tmpPerm.SetIpv6Ranges([]*ec2.Ipv6Range{&ipr})
+		} else {
+			var ipr ec2.IpRange
+			ipr.SetCidrIp(entry.IP)
+			ipr.SetDescription(describe(entry))
+			tmpPerm.SetIpRanges([]*ec2.IpRange{&ipr})
+		}
 
 		permissions = append(permissions, &tmpPerm)
 	}
@@ -193,19 +433,17 @@ func (a *AwsContext) SetSecurityGroupIDFromEnv() error {
 	return nil
 }
 
-// Check if the required list of environment variables have been set. Return
-// an error if any of them are missing. Some of these will be read by the AWS
-// Go SDK directly.
-func checkEnvVars() error {
-	envVars := []string{
-		"AWS_ACCESS_KEY_ID",
-		"AWS_SECRET_ACCESS_KEY",
-		"AWS_DEFAULT_REGION",
-		"AWS_VPC_ID",
-		"AWS_SGMANAGER_OWNER_ID",
-		"AWS_SECURITY_GROUP_ID",
-	}
+// Check that the environment variables needed however the targets and owner
+// ID are configured have been set. Some of these will be read by the AWS Go
+// SDK directly. Credentials are deliberately not checked here since the SDK
+// default chain may find them somewhere other than the environment.
+func CheckRequiredEnvVars() error {
+	return checkEnvVars("AWS_DEFAULT_REGION", "AWS_VPC_ID")
+}
 
+// Check if the required list of environment variables have been set. Return
+// an error if any of them are missing.
+func checkEnvVars(envVars ...string) error {
 	for _, e := range envVars {
 		if os.Getenv(e) == "" {
 			errorMessage := fmt.Sprintf("Env var %s not set", e)
@@ -217,14 +455,21 @@ func checkEnvVars() error {
 }
 
 // Get all the inbound rules that are part of the current Security Group.
-func (a *AwsContext) GetInboundRules() ([]*ec2.IpPermission, error) {
-	securityGroups, err := a.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
-		GroupIds: []*string{&a.SecurityGroupID},
+func (a *AwsContext) GetInboundRules(ctx context.Context) ([]*ec2.IpPermission, error) {
+	return a.getInboundRules(ctx, a.SecurityGroupID)
+}
+
+func (a *AwsContext) getInboundRules(ctx context.Context, groupID string) ([]*ec2.IpPermission, error) {
+	securityGroups, err := a.ec2.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+		GroupIds: []*string{&groupID},
 	})
 
 	if err != nil {
 		return nil, fmt.Errorf("GetInboundRules error: %w", err)
 	}
+	if len(securityGroups.SecurityGroups) == 0 {
+		return nil, fmt.Errorf("GetInboundRules error: security group %s not found", groupID)
+	}
 
 	var results []*ec2.IpPermission
 	results = securityGroups.SecurityGroups[0].IpPermissions
@@ -233,67 +478,178 @@ func (a *AwsContext) GetInboundRules() ([]*ec2.IpPermission, error) {
 
 // Get the inbound rules that are under the current Security Group and tagged
 // as owned by OwnerID.
-func (a *AwsContext) GetInboundRulesOwnedByID() ([]*ec2.IpPermission, error) {
-	originalSet, err := a.GetInboundRules()
+func (a *AwsContext) GetInboundRulesOwnedByID(ctx context.Context) ([]*ec2.IpPermission, error) {
+	originalSet, err := a.GetInboundRules(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("GetInboundRulesOwnedByID error: %w", err)
 	}
 
-	results := filterInboundRules(originalSet, &a.OwnerID, true)
+	results := filterInboundRules(originalSet, a.identity(), true)
 	return results, nil
 }
 
 // Get the inbound rules that are under the current Security Group and are not
 // tagged as owned by OwnerID.
-func (a *AwsContext) GetInboundRulesNotOwnedByID() ([]*ec2.IpPermission, error) {
-	originalSet, err := a.GetInboundRules()
+func (a *AwsContext) GetInboundRulesNotOwnedByID(ctx context.Context) ([]*ec2.IpPermission, error) {
+	originalSet, err := a.GetInboundRules(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("GetInboundRulesOwnedByID error: %w", err)
 	}
 
-	results := filterInboundRules(originalSet, &a.OwnerID, false)
+	results := filterInboundRules(originalSet, a.identity(), false)
 	return results, nil
 }
 
-func isRuleOwnedByID(rule *ec2.IpPermission, ownerID *string) bool {
-	owner, _ := ParseDescription(rule.IpRanges[0].Description)
-	if owner == nil {
-		return false
+func isRuleOwnedByID(rule *ec2.IpPermission, owner *ownerIdentity) bool {
+	return classifyRule(rule, owner) == ruleOwned
+}
+
+// Decide how an expanded rule relates to owner. Only CIDR rules are ever
+// created by us, so rules referencing a prefix list or another security group
+// are always foreign, whatever their description says.
+func classifyRule(rule *ec2.IpPermission, owner *ownerIdentity) ruleOwnership {
+	source := ruleSourceOf(rule)
+	if source == nil || !source.isCidr() {
+		return ruleForeign
+	}
+
+	return owner.classifyDescription(source.Description, &RuleEntry{
+		Protocol: aws.StringValue(rule.IpProtocol),
+		FromPort: aws.Int64Value(rule.FromPort),
+		ToPort:   aws.Int64Value(rule.ToPort),
+		IP:       source.ID,
+	})
+}
+
+// Identifies the rule an expanded ec2.IpPermission stands for, in the same
+// form as RuleEntry.key.
+func permissionKey(rule *ec2.IpPermission) string {
+	id := ""
+	if source := ruleSourceOf(rule); source != nil {
+		id = source.ID
+	}
+
+	return fmt.Sprintf("%s/%d-%d/%s", aws.StringValue(rule.IpProtocol), aws.Int64Value(rule.FromPort),
+		aws.Int64Value(rule.ToPort), id)
+}
+
+// Kinds of sources an inbound rule can let traffic in from.
+const (
+	sourceIPv4       = "ipv4"
+	sourceIPv6       = "ipv6"
+	sourcePrefixList = "prefix-list"
+	sourceGroupPair  = "security-group"
+)
+
+// The single source of an expanded rule.
+type ruleSource struct {
+	Kind string
+
+	// The CIDR, prefix list ID or security group ID, with the account ID
+	// in front for security groups of other accounts.
+	ID          string
+	Description *string
+}
+
+func (s *ruleSource) isCidr() bool {
+	return s.Kind == sourceIPv4 || s.Kind == sourceIPv6
+}
+
+// Get the source of an expanded rule. nil is returned if the rule doesn't
+// have exactly one source.
+func ruleSourceOf(rule *ec2.IpPermission) *ruleSource {
+	if countRules([]*ec2.IpPermission{rule}) != 1 {
+		return nil
 	}
 
-	return *owner == *ownerID
+	switch {
+	case len(rule.IpRanges) == 1:
+		return &ruleSource{Kind: sourceIPv4, ID: aws.StringValue(rule.IpRanges[0].CidrIp),
+			Description: rule.IpRanges[0].Description}
+	case len(rule.Ipv6Ranges) == 1:
+		return &ruleSource{Kind: sourceIPv6, ID: aws.StringValue(rule.Ipv6Ranges[0].CidrIpv6),
+			Description: rule.Ipv6Ranges[0].Description}
+	case len(rule.PrefixListIds) == 1:
+		return &ruleSource{Kind: sourcePrefixList, ID: aws.StringValue(rule.PrefixListIds[0].PrefixListId),
+			Description: rule.PrefixListIds[0].Description}
+	default:
+		pair := rule.UserIdGroupPairs[0]
+		id := aws.StringValue(pair.GroupId)
+		if pair.UserId != nil {
+			id = aws.StringValue(pair.UserId) + "/" + id
+		}
+		return &ruleSource{Kind: sourceGroupPair, ID: id, Description: pair.Description}
+	}
+}
+
+// Get the description of the single source of an expanded rule.
+func ruleDescription(rule *ec2.IpPermission) string {
+	if source := ruleSourceOf(rule); source != nil {
+		return aws.StringValue(source.Description)
+	}
+
+	return ""
 }
 
 // AWS tends to lump up several IpPermission objects together if their protocol
-// and port ranges match and then put the differences into an ipRanges array.
-// This function will create new ec2.IpPermission objects for each of those
-// IpRange entries.
+// and port ranges match and then put the differences into the IpRanges,
+// Ipv6Ranges, PrefixListIds and UserIdGroupPairs arrays. This function will
+// create a new ec2.IpPermission object for each of those sources, leaving the
+// sources themselves untouched so that rules can be put back exactly as they
+// were.
 func expandRules(rules []*ec2.IpPermission) []*ec2.IpPermission {
 	results := make([]*ec2.IpPermission, 0)
 
+	newRule := func(rule *ec2.IpPermission) *ec2.IpPermission {
+		var result ec2.IpPermission
+		result.FromPort = rule.FromPort
+		result.ToPort = rule.ToPort
+		result.IpProtocol = rule.IpProtocol
+		return &result
+	}
+
 	for _, rule := range rules {
+		if rule == nil {
+			continue
+		}
+
 		for _, iprange := range rule.IpRanges {
-			var newRule ec2.IpPermission
-			newRule.FromPort = rule.FromPort
-			newRule.ToPort = rule.ToPort
-			newRule.IpProtocol = rule.IpProtocol
-			newRule.IpRanges = make([]*ec2.IpRange, 0)
-			newRule.IpRanges = append(newRule.IpRanges, iprange)
-			results = append(results, &newRule)
+			expanded := newRule(rule)
+			expanded.IpRanges = []*ec2.IpRange{iprange}
+			results = append(results, expanded)
+		}
+		for _, iprange := range rule.Ipv6Ranges {
+			expanded := newRule(rule)
+			expanded.Ipv6Ranges = []*ec2.Ipv6Range{iprange}
+			results = append(results, expanded)
+		}
+		for _, prefixList := range rule.PrefixListIds {
+			expanded := newRule(rule)
+			expanded.PrefixListIds = []*ec2.PrefixListId{prefixList}
+			results = append(results, expanded)
+		}
+		for _, pair := range rule.UserIdGroupPairs {
+			expanded := newRule(rule)
+			expanded.UserIdGroupPairs = []*ec2.UserIdGroupPair{pair}
+			results = append(results, expanded)
 		}
 	}
 
 	return results
 }
 
+func isIPv6Cidr(cidr string) bool {
+	return strings.Contains(cidr, ":")
+}
+
 // Given a list of ec2.IpPermission objects, return the ones that are owned by
-// ownerID if returnOwned is true. Do the opposite otherwise.
-func filterInboundRules(rules []*ec2.IpPermission, ownerID *string, returnOwned bool) []*ec2.IpPermission {
+// owner if returnOwned is true. Do the opposite otherwise.
+func filterInboundRules(rules []*ec2.IpPermission, owner *ownerIdentity, returnOwned bool) []*ec2.IpPermission {
 	results := make([]*ec2.IpPermission, 0)
 
 	expandedRules := expandRules(rules)
 	for _, rule := range expandedRules {
-		ruleIsOwned := isRuleOwnedByID(rule, ownerID)
+		ruleIsOwned := isRuleOwnedByID(rule, owner)
 		if (returnOwned && ruleIsOwned) ||
 			(!returnOwned && !ruleIsOwned) {
 			results = append(results, rule)
@@ -303,12 +659,49 @@ func filterInboundRules(rules []*ec2.IpPermission, ownerID *string, returnOwned
 	return results
 }
 
-func (a *AwsContext) SetInboundRules(rules []*ec2.IpPermission) error {
+// Authorize rules on the security group. Unlike the internal callers, which
+// may well end up with nothing to add, an empty rule set is an error here.
+func (a *AwsContext) SetInboundRules(ctx context.Context, rules []*ec2.IpPermission) error {
+	if len(rules) == 0 {
+		return fmt.Errorf("Error setting inbound rules: no rules given")
+	}
+
+	ctx, flushAudit := a.bufferAudit(ctx)
+	defer flushAudit()
+
+	return a.setInboundRules(ctx, a.SecurityGroupID, rules)
+}
+
+func (a *AwsContext) setInboundRules(ctx context.Context, groupID string, rules []*ec2.IpPermission) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	rules = expandRules(rules)
+	return a.inBatches(groupID, "Authorize", len(rules), func(start int, end int) error {
+		batch := rules[start:end]
+		err := a.authorizeIngress(ctx, groupID, batch)
+		if isAwsErrorCode(err, errCodeDuplicatePermission) && len(batch) > 1 {
+			// one of the rules is already there, which fails all of them
+			return applyEach(groupID, len(batch), errCodeDuplicatePermission, func(i int) string {
+				return permissionKey(batch[i])
+			}, func(i int) error {
+				return a.authorizeIngress(ctx, groupID, batch[i:i+1])
+			})
+		}
+
+		return err
+	})
+}
+
+func (a *AwsContext) authorizeIngress(ctx context.Context, groupID string, rules []*ec2.IpPermission) error {
 	var ingressInput ec2.AuthorizeSecurityGroupIngressInput
 	ingressInput.SetIpPermissions(rules)
-	ingressInput.SetGroupId(a.SecurityGroupID)
+	ingressInput.SetGroupId(groupID)
 
-	_, err := a.ec2.AuthorizeSecurityGroupIngress(&ingressInput)
+	var requestID string
+	_, err := a.ec2.AuthorizeSecurityGroupIngressWithContext(ctx, &ingressInput, captureRequestID(&requestID))
+	a.audit(ctx, groupID, AuditAuthorize, auditRules(rules), nil, requestID, err)
 	if err != nil {
 		return fmt.Errorf("Error setting inbound rules: %w", err)
 	}
@@ -316,24 +709,60 @@ func (a *AwsContext) SetInboundRules(rules []*ec2.IpPermission) error {
 	return nil
 }
 
-func (a *AwsContext) DeleteInboundRules(rules []*ec2.IpPermission) error {
+func (a *AwsContext) DeleteInboundRules(ctx context.Context, rules []*ec2.IpPermission) error {
+	ctx, flushAudit := a.bufferAudit(ctx)
+	defer flushAudit()
+
+	return a.deleteInboundRules(ctx, a.SecurityGroupID, rules)
+}
+
+func (a *AwsContext) deleteInboundRules(ctx context.Context, groupID string, rules []*ec2.IpPermission) error {
 	if len(rules) == 0 {
 		return nil
 	}
 
+	rules = expandRules(rules)
+	return a.inBatches(groupID, "Revoke", len(rules), func(start int, end int) error {
+		batch := rules[start:end]
+		err := a.revokeIngress(ctx, groupID, batch)
+		if isAwsErrorCode(err, errCodePermissionNotFound) && len(batch) > 1 {
+			// one of the rules is already gone, which fails all of them
+			return applyEach(groupID, len(batch), errCodePermissionNotFound, func(i int) string {
+				return permissionKey(batch[i])
+			}, func(i int) error {
+				return a.revokeIngress(ctx, groupID, batch[i:i+1])
+			})
+		}
+
+		return err
+	})
+}
+
+func (a *AwsContext) revokeIngress(ctx context.Context, groupID string, rules []*ec2.IpPermission) error {
 	var ingressInput ec2.RevokeSecurityGroupIngressInput
 	ingressInput.SetIpPermissions(rules)
-	ingressInput.SetGroupId(a.SecurityGroupID)
+	ingressInput.SetGroupId(groupID)
 
-	_, err := a.ec2.RevokeSecurityGroupIngress(&ingressInput)
+	var requestID string
+	output, err := a.ec2.RevokeSecurityGroupIngressWithContext(ctx, &ingressInput, captureRequestID(&requestID))
+	a.audit(ctx, groupID, AuditRevoke, nil, auditRules(rules), requestID, err)
 	if err != nil {
 		return fmt.Errorf("Error deleting inbound rules: %w", err)
 	}
 
+	// rules that are already gone may also be reported here instead of
+	// failing the call
+	for _, rule := range expandRules(output.UnknownIpPermissions) {
+		fmt.Printf("Skipping %s in %s: already gone\n", permissionKey(rule), groupID)
+	}
+
 	return nil
 }
 
-func (a *AwsContext) DeleteRuleEntries(entries []*RuleEntry) error {
+func (a *AwsContext) DeleteRuleEntries(ctx context.Context, entries []*RuleEntry) error {
+	ctx, flushAudit := a.bufferAudit(ctx)
+	defer flushAudit()
+
 	if len(entries) == 0 {
 		return nil
 	}
@@ -343,5 +772,5 @@ func (a *AwsContext) DeleteRuleEntries(entries []*RuleEntry) error {
 		return fmt.Errorf("Error converting RuleEntry structs to ec2.IpPermission structs")
 	}
 
-	return a.DeleteInboundRules(permissions)
+	return a.DeleteInboundRules(ctx, permissions)
 }
@@ -1,8 +1,10 @@
 package awsclient
 
 import (
+	"context"
 	"testing"
 
+	awssdk "github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
@@ -22,12 +24,12 @@ func TestReplaceOwnedEntries(t *testing.T) {
 			&RuleEntry{NodeName: "node5", OwnerID: aws.OwnerID, FromPort: 2345, ToPort: 5432, IP: "192.172.0.5/32", Protocol: "tcp"},
 		}
 
-		err = aws.ReplaceOwnedEntries(validEntries)
+		err = aws.ReplaceOwnedEntries(context.Background(), validEntries)
 		if err != nil {
 			t.Errorf("ReplaceOwnedEntries failure: %s", err)
 		}
 
-		ownedEntries, err := aws.GetInboundRules()
+		ownedEntries, err := aws.GetInboundRules(context.Background())
 		if err != nil {
 			t.Errorf("Could not get owned entries: %s", err)
 		}
@@ -37,7 +39,7 @@ func TestReplaceOwnedEntries(t *testing.T) {
 		}
 
 		// cleanup by deleting the rules we added in
-		err = aws.DeleteRuleEntries(validEntries)
+		err = aws.DeleteRuleEntries(context.Background(), validEntries)
 		if err != nil {
 			t.Fatalf("Could not cleanup inserted rules in security group!")
 		}
@@ -57,10 +59,10 @@ func TestGetDescription(t *testing.T) {
 	}
 
 	expectedDescriptions := []string{
-		"ownerid=aaa ; nodename=aaa",
-		"ownerid=333 ; nodename=333",
-		"ownerid=a-3 ; nodename=a-3",
-		"ownerid=aaaaaaaaaaaaaaaaaa ; nodename=aaaaaaaaaaaaaaaaaa",
+		"sgm/v2 owner=aaa node=aaa",
+		"sgm/v2 owner=333 node=333",
+		"sgm/v2 owner=a-3 node=a-3",
+		"sgm/v2 owner=aaaaaaaaaaaaaaaaaa node=aaaaaaaaaaaaaaaaaa",
 	}
 
 	for idx, rule := range validRules {
@@ -99,6 +101,75 @@ func TestRuleEntryFromDescription(t *testing.T) {
 	//TODO tests here for invalid descriptions
 }
 
+func TestFilterInboundRulesMixedSources(t *testing.T) {
+	owner := &ownerIdentity{ID: "owner"}
+	marker := "sgm/v2 owner=owner node=node1"
+	foreignV4 := &ec2.IpRange{CidrIp: awssdk.String("10.0.0.2/32"), Description: awssdk.String("by hand")}
+	foreignV6 := &ec2.Ipv6Range{CidrIpv6: awssdk.String("2001:db8::1/128")}
+	prefixList := &ec2.PrefixListId{PrefixListId: awssdk.String("pl-1234"), Description: awssdk.String(marker)}
+	pair := &ec2.UserIdGroupPair{GroupId: awssdk.String("sg-5678"), UserId: awssdk.String("123456789012")}
+
+	rules := []*ec2.IpPermission{
+		&ec2.IpPermission{
+			IpProtocol: awssdk.String("tcp"),
+			FromPort:   awssdk.Int64(5432),
+			ToPort:     awssdk.Int64(5432),
+			IpRanges: []*ec2.IpRange{
+				&ec2.IpRange{CidrIp: awssdk.String("10.0.0.1/32"), Description: awssdk.String(marker)},
+				foreignV4,
+			},
+			Ipv6Ranges: []*ec2.Ipv6Range{
+				&ec2.Ipv6Range{CidrIpv6: awssdk.String("2001:db8::2/128"), Description: awssdk.String(marker)},
+				foreignV6,
+			},
+			PrefixListIds: []*ec2.PrefixListId{prefixList},
+		},
+		// all traffic rules come without ports
+		&ec2.IpPermission{
+			IpProtocol:       awssdk.String("-1"),
+			UserIdGroupPairs: []*ec2.UserIdGroupPair{pair},
+		},
+		&ec2.IpPermission{IpProtocol: awssdk.String("tcp")},
+	}
+
+	owned := filterInboundRules(rules, owner, true)
+	entries := ruleEntriesFromOwnedRules(owned)
+	if len(entries) != 2 || entries[0].IP != "10.0.0.1/32" || entries[1].IP != "2001:db8::2/128" {
+		t.Errorf("Expected the IPv4 and IPv6 rules with our marker to be owned, got %v", entries)
+	}
+
+	foreign := filterInboundRules(rules, owner, false)
+	if len(foreign) != 4 {
+		t.Fatalf("Expected 4 foreign rules, got %v", foreign)
+	}
+	if foreign[0].IpRanges[0] != foreignV4 || foreign[1].Ipv6Ranges[0] != foreignV6 ||
+		foreign[2].PrefixListIds[0] != prefixList || foreign[3].UserIdGroupPairs[0] != pair {
+		t.Errorf("Expected foreign rules to be kept exactly as they were, got %v", foreign)
+	}
+	if key := permissionKey(foreign[3]); key != "-1/0-0/123456789012/sg-5678" {
+		t.Errorf("Unexpected key %s for a security group rule", key)
+	}
+
+	if len(filterInboundRules(nil, owner, true)) != 0 || len(ruleEntriesFromOwnedRules(nil)) != 0 {
+		t.Errorf("Expected no rules from an empty group")
+	}
+}
+
+func TestRuleEntriesToIpPermissionsIPv6(t *testing.T) {
+	entries := []*RuleEntry{
+		&RuleEntry{NodeName: "node1", OwnerID: "owner", FromPort: 1, ToPort: 1, IP: "10.0.0.1/32", Protocol: "tcp"},
+		&RuleEntry{NodeName: "node1", OwnerID: "owner", FromPort: 1, ToPort: 1, IP: "2001:db8::1/128", Protocol: "tcp"},
+	}
+
+	permissions := RuleEntriesToAwsIpPermissions(entries)
+	if len(permissions[0].IpRanges) != 1 || len(permissions[0].Ipv6Ranges) != 0 {
+		t.Errorf("Expected an IPv4 range, got %v", permissions[0])
+	}
+	if len(permissions[1].IpRanges) != 0 || len(permissions[1].Ipv6Ranges) != 1 {
+		t.Errorf("Expected an IPv6 range, got %v", permissions[1])
+	}
+}
+
 func TestGetInboundRules(t *testing.T) {
 	var aws AwsContext
 	err := aws.Init()
@@ -109,7 +180,7 @@ func TestGetInboundRules(t *testing.T) {
 
 	// test with the env var provided security group
 	t.Run("Security group from env var", func(t *testing.T) {
-		_, err := aws.GetInboundRules()
+		_, err := aws.GetInboundRules(context.Background())
 
 		if err != nil {
 			t.Errorf("AWS_SECURITY_GROUP_ID env var is invalid, continuing anyway")
@@ -120,7 +191,7 @@ func TestGetInboundRules(t *testing.T) {
 	t.Run("Invalid security group", func(t *testing.T) {
 		invalidID := "INVALID"
 		aws.SecurityGroupID = invalidID
-		_, err := aws.GetInboundRules()
+		_, err := aws.GetInboundRules(context.Background())
 
 		if err == nil {
 			t.Errorf("Expected an error, but got none")
@@ -147,13 +218,13 @@ func TestSetInboundRules(t *testing.T) {
 		rule.SetIpProtocol("tcp")
 		rule.SetIpRanges([]*ec2.IpRange{&ipRange})
 
-		err = aws.SetInboundRules([]*ec2.IpPermission{&rule})
+		err = aws.SetInboundRules(context.Background(), []*ec2.IpPermission{&rule})
 		if err != nil {
 			t.Errorf("Error setting inbound rules: %s", err)
 		}
 
 		// cleanup
-		err = aws.DeleteInboundRules([]*ec2.IpPermission{&rule})
+		err = aws.DeleteInboundRules(context.Background(), []*ec2.IpPermission{&rule})
 		if err != nil {
 			t.Fatalf("Error cleaning up: %s", err)
 		}
@@ -162,7 +233,7 @@ func TestSetInboundRules(t *testing.T) {
 	t.Run("Valid security group, invalid rules", func(t *testing.T) {
 		var rules []*ec2.IpPermission
 
-		err = aws.SetInboundRules(rules)
+		err = aws.SetInboundRules(context.Background(), rules)
 
 		if err == nil {
 			t.Errorf("Expected an error while setting invalid rules but got none")
@@ -174,7 +245,7 @@ func TestSetInboundRules(t *testing.T) {
 
 		securityGroupID := "INVALID"
 		aws.SecurityGroupID = securityGroupID
-		err = aws.SetInboundRules(rules)
+		err = aws.SetInboundRules(context.Background(), rules)
 
 		if err == nil {
 			t.Errorf("Expected an error setting rules on an invalid security group but got none")
@@ -201,3 +272,39 @@ func TestGetInboundRulesNotOwnedByID(t *testing.T) {
 
 	//TODO implement me
 }
+
+func TestDiffOwnedRules(t *testing.T) {
+	owner := &ownerIdentity{ID: "me"}
+	rule := func(description string, cidr string) *ec2.IpPermission {
+		return &ec2.IpPermission{
+			IpProtocol: awssdk.String("tcp"),
+			FromPort:   awssdk.Int64(5432),
+			ToPort:     awssdk.Int64(5432),
+			IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: awssdk.String(cidr), Description: awssdk.String(description)}},
+		}
+	}
+
+	current := []*ec2.IpPermission{
+		rule(owner.descriptionFor(&RuleEntry{NodeName: "node1", OwnerID: "me", FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"}), "10.0.0.1/32"),
+		rule(owner.descriptionFor(&RuleEntry{NodeName: "node2", OwnerID: "me", FromPort: 5432, ToPort: 5432, IP: "10.0.0.2/32", Protocol: "tcp"}), "10.0.0.2/32"),
+		rule(owner.descriptionFor(&RuleEntry{NodeName: "node3", OwnerID: "me", FromPort: 5432, ToPort: 5432, IP: "10.0.0.3/32", Protocol: "tcp"}), "10.0.0.3/32"),
+		rule("office", "10.0.0.4/32"),
+	}
+	entries := []*RuleEntry{
+		&RuleEntry{NodeName: "node1", OwnerID: "me", FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"},
+		&RuleEntry{NodeName: "node2-renamed", OwnerID: "me", FromPort: 5432, ToPort: 5432, IP: "10.0.0.2/32", Protocol: "tcp"},
+		&RuleEntry{NodeName: "node4", OwnerID: "me", FromPort: 5432, ToPort: 5432, IP: "10.0.0.4/32", Protocol: "tcp"},
+		&RuleEntry{NodeName: "node5", OwnerID: "me", FromPort: 5432, ToPort: 5432, IP: "10.0.0.5/32", Protocol: "tcp"},
+	}
+
+	changes := diffOwnedRules("sg-1", current, entries, owner)
+	if len(changes.authorize) != 1 || changes.authorize[0].IP != "10.0.0.5/32" {
+		t.Errorf("Expected only 10.0.0.5/32 to be authorized, got %v", changes.authorize)
+	}
+	if len(changes.describe) != 1 || changes.describe[0].NodeName != "node2-renamed" {
+		t.Errorf("Expected the description of 10.0.0.2/32 to be updated, got %v", changes.describe)
+	}
+	if len(changes.revoke) != 1 || permissionKey(changes.revoke[0]) != "tcp/5432-5432/10.0.0.3/32" {
+		t.Errorf("Expected only 10.0.0.3/32 to be revoked, got %v", changes.revoke)
+	}
+}
@@ -0,0 +1,93 @@
+package awsclient
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// How many rules a single authorize, revoke or description update call
+// carries unless AWS_SGMANAGER_BATCH_SIZE says otherwise. Calls with many
+// more rules than this run into the EC2 request size limits.
+const defaultBatchSize = 50
+
+// Load the batch size from AWS_SGMANAGER_BATCH_SIZE.
+func BatchSizeFromEnv() (int, error) {
+	value := os.Getenv("AWS_SGMANAGER_BATCH_SIZE")
+	if value == "" {
+		return defaultBatchSize, nil
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 {
+		return 0, fmt.Errorf("Invalid AWS_SGMANAGER_BATCH_SIZE value: %s", value)
+	}
+
+	return size, nil
+}
+
+// Returned when a call failed for one batch of the rules of a change that
+// was split over several calls. The other batches were still applied.
+type BatchError struct {
+	GroupID   string
+	Operation string
+	Batch     int
+	Batches   int
+	Rules     int
+	Err       error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%s batch %d of %d (%d rules) in %s failed: %s",
+		e.Operation, e.Batch, e.Batches, e.Rules, e.GroupID, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+func (a *AwsContext) batchSize() int {
+	if a.BatchSize < 1 {
+		return defaultBatchSize
+	}
+
+	return a.BatchSize
+}
+
+// Split count rules into batches and call apply with the bounds of each.
+// A failing batch doesn't stop the others, every failure is logged and the
+// first one returned as a BatchError. Changes that fit in a single batch
+// return the error of apply as it is.
+func (a *AwsContext) inBatches(groupID string, operation string, count int, apply func(start int, end int) error) error {
+	size := a.batchSize()
+	if count <= size {
+		return apply(0, count)
+	}
+
+	batches := (count + size - 1) / size
+	var result error
+	for batch := 0; batch < batches; batch++ {
+		start := batch * size
+		end := minInt(start+size, count)
+
+		err := apply(start, end)
+		if err == nil {
+			continue
+		}
+
+		batchErr := &BatchError{
+			GroupID:   groupID,
+			Operation: operation,
+			Batch:     batch + 1,
+			Batches:   batches,
+			Rules:     end - start,
+			Err:       err,
+		}
+		fmt.Printf("Warning: %s\n", batchErr)
+		if result == nil {
+			result = batchErr
+		}
+	}
+
+	return result
+}
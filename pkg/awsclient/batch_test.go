@@ -0,0 +1,60 @@
+package awsclient
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestBatchSizeFromEnv(t *testing.T) {
+	defer os.Unsetenv("AWS_SGMANAGER_BATCH_SIZE")
+
+	size, err := BatchSizeFromEnv()
+	if err != nil || size != defaultBatchSize {
+		t.Errorf("Expected the default batch size, got %d, %v", size, err)
+	}
+
+	os.Setenv("AWS_SGMANAGER_BATCH_SIZE", "20")
+	size, err = BatchSizeFromEnv()
+	if err != nil || size != 20 {
+		t.Errorf("Expected a batch size of 20, got %d, %v", size, err)
+	}
+
+	os.Setenv("AWS_SGMANAGER_BATCH_SIZE", "0")
+	if _, err = BatchSizeFromEnv(); err == nil {
+		t.Errorf("Expected a batch size of 0 to be refused")
+	}
+}
+
+func TestInBatches(t *testing.T) {
+	a := AwsContext{BatchSize: 2}
+	failure := errors.New("request too large")
+
+	bounds := make([][2]int, 0)
+	err := a.inBatches("sg-1", "Authorize", 5, func(start int, end int) error {
+		bounds = append(bounds, [2]int{start, end})
+		if start == 2 {
+			return failure
+		}
+		return nil
+	})
+
+	if len(bounds) != 3 || bounds[0] != [2]int{0, 2} || bounds[1] != [2]int{2, 4} || bounds[2] != [2]int{4, 5} {
+		t.Errorf("Unexpected batches %v", bounds)
+	}
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Batch != 2 || batchErr.Batches != 3 || batchErr.Rules != 2 {
+		t.Fatalf("Expected the second batch to be reported, got %v", err)
+	}
+	if !errors.Is(err, failure) {
+		t.Errorf("Expected the batch error to wrap the call error")
+	}
+
+	err = a.inBatches("sg-1", "Revoke", 2, func(start int, end int) error {
+		return failure
+	})
+	if err != failure {
+		t.Errorf("Expected a single batch to return its error as it is, got %v", err)
+	}
+}
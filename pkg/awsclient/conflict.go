@@ -0,0 +1,138 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/metrics"
+)
+
+// A heartbeat from another instance under the same owner ID blocks changes
+// for this long unless AWS_SGMANAGER_CONFLICT_WINDOW says otherwise. It needs
+// to be longer than the time between two reconciles.
+const defaultConflictWindow = 10 * time.Minute
+
+// Load the conflict window from AWS_SGMANAGER_CONFLICT_WINDOW.
+func ConflictWindowFromEnv() (time.Duration, error) {
+	value := os.Getenv("AWS_SGMANAGER_CONFLICT_WINDOW")
+	if value == "" {
+		return defaultConflictWindow, nil
+	}
+
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("Invalid AWS_SGMANAGER_CONFLICT_WINDOW value: %s", value)
+	}
+
+	return window, nil
+}
+
+// Returned instead of changing anything when another instance recently
+// managed the same target under the same owner ID. Two instances sharing an
+// owner ID would otherwise keep removing each other's rules.
+type OwnerConflictError struct {
+	Target        Target
+	OwnerID       string
+	InstanceID    string
+	OtherInstance string
+	LastHeartbeat time.Time
+}
+
+func (e *OwnerConflictError) Error() string {
+	return fmt.Sprintf("Instance %s wrote to %s as owner %s at %s, but this is instance %s. "+
+		"Two instances are sharing an owner ID, not changing anything until one of them is given another one",
+		e.OtherInstance, e.Target, e.OwnerID, e.LastHeartbeat.Format(time.RFC3339), e.InstanceID)
+}
+
+// Write the heartbeat of this instance, then check that no other instance
+// recently wrote one for this owner ID. Since every instance writes its own
+// heartbeat before looking for others, instances that start sharing an owner
+// ID at the same time all see each other and all stop. Nothing is checked when
+// the instance is unknown.
+//
+// A heartbeat that can't be written doesn't stop the reconcile, but it is
+// logged and counted, since an owner without heartbeats eventually counts as
+// expired. Heartbeats of other instances of this owner that are too old to
+// matter are removed.
+func (a *AwsContext) claimOwnerID(ctx context.Context) error {
+	err := a.writeHeartbeat(ctx)
+	written := err == nil
+	if !written {
+		fmt.Printf("Warning: %s\n", err)
+		metrics.HeartbeatFailures.WithLabelValues(a.Target.String()).Inc()
+	}
+
+	heartbeats, err := a.getHeartbeats(ctx)
+	if err != nil {
+		return err
+	}
+	owned := heartbeatsOf(heartbeats, a.OwnerID)
+
+	if written {
+		stale := staleHeartbeats(owned, instanceHeartbeatTagKey(a.OwnerID, a.InstanceID), a.conflictWindow(), time.Now())
+		err = a.deleteHeartbeats(ctx, stale)
+		if err != nil {
+			fmt.Printf("Warning: couldn't remove stale heartbeats: %s\n", err)
+		}
+	}
+
+	return a.checkOwnerConflict(owned, time.Now())
+}
+
+// Get the heartbeats among those of our owner ID, other than ours at
+// ownKey, that are older than the conflict window. They neither block
+// anything nor keep the owner alive once ours is written, so they're only
+// left over from instances that are gone.
+func staleHeartbeats(heartbeats map[string]*heartbeat, ownKey string, window time.Duration, now time.Time) map[string]*heartbeat {
+	results := make(map[string]*heartbeat)
+	for key, beat := range heartbeats {
+		if key != ownKey && now.Sub(beat.Time) > window {
+			results[key] = beat
+		}
+	}
+
+	return results
+}
+
+// Check whether any of heartbeats, those of our owner ID, was written by
+// another instance within the conflict window.
+func (a *AwsContext) checkOwnerConflict(heartbeats map[string]*heartbeat, now time.Time) error {
+	if a.InstanceID == "" {
+		return nil
+	}
+
+	keys := make([]string, 0)
+	for key := range heartbeats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		beat := heartbeats[key]
+		if beat.InstanceID == "" || beat.InstanceID == a.InstanceID || now.Sub(beat.Time) > a.conflictWindow() {
+			continue
+		}
+
+		return &OwnerConflictError{
+			Target:        a.Target,
+			OwnerID:       a.OwnerID,
+			InstanceID:    a.InstanceID,
+			OtherInstance: beat.InstanceID,
+			LastHeartbeat: beat.Time,
+		}
+	}
+
+	return nil
+}
+
+// How long a heartbeat counts as recent.
+func (a *AwsContext) conflictWindow() time.Duration {
+	if a.ConflictWindow == 0 {
+		return defaultConflictWindow
+	}
+
+	return a.ConflictWindow
+}
@@ -0,0 +1,64 @@
+package awsclient
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckOwnerConflict(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	a := AwsContext{OwnerID: "cluster", InstanceID: "uid-a", ConflictWindow: 10 * time.Minute}
+	ours := instanceHeartbeatTagKey("cluster", "uid-a")
+	theirs := instanceHeartbeatTagKey("cluster", "uid-b")
+
+	allowed := []map[string]*heartbeat{
+		nil,
+		{heartbeatTagKey("cluster"): &heartbeat{Time: now}},
+		{ours: &heartbeat{Time: now, InstanceID: "uid-a"}},
+		// written by a version that kept one heartbeat per owner
+		{heartbeatTagKey("cluster"): &heartbeat{Time: now, InstanceID: "uid-a"}},
+		{ours: &heartbeat{Time: now, InstanceID: "uid-a"}, theirs: &heartbeat{Time: now.Add(-time.Hour), InstanceID: "uid-b"}},
+	}
+	for _, heartbeats := range allowed {
+		if err := a.checkOwnerConflict(heartbeats, now); err != nil {
+			t.Errorf("Expected heartbeats %v not to conflict, got %s", heartbeats, err)
+		}
+	}
+
+	heartbeats := map[string]*heartbeat{
+		ours:   &heartbeat{Time: now, InstanceID: "uid-a"},
+		theirs: &heartbeat{Time: now.Add(-time.Minute), InstanceID: "uid-b"},
+	}
+	err := a.checkOwnerConflict(heartbeats, now)
+	var conflict *OwnerConflictError
+	if !errors.As(err, &conflict) || conflict.OtherInstance != "uid-b" {
+		t.Errorf("Expected a conflict with uid-b, got %v", err)
+	}
+
+	// the other instance sees the heartbeat of this one just the same
+	b := AwsContext{OwnerID: "cluster", InstanceID: "uid-b", ConflictWindow: 10 * time.Minute}
+	if err := b.checkOwnerConflict(heartbeats, now); !errors.As(err, &conflict) || conflict.OtherInstance != "uid-a" {
+		t.Errorf("Expected a conflict with uid-a, got %v", err)
+	}
+
+	a.InstanceID = ""
+	if err := a.checkOwnerConflict(heartbeats, now); err != nil {
+		t.Errorf("Expected no check without an instance ID, got %s", err)
+	}
+}
+
+func TestStaleHeartbeats(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	ours := instanceHeartbeatTagKey("cluster", "uid-a")
+	heartbeats := map[string]*heartbeat{
+		ours:                       &heartbeat{Time: now.Add(-time.Hour), InstanceID: "uid-a"},
+		heartbeatTagKey("cluster"): &heartbeat{Time: now.Add(-time.Hour), InstanceID: "uid-a"},
+		instanceHeartbeatTagKey("cluster", "uid-b"): &heartbeat{Time: now.Add(-time.Minute), InstanceID: "uid-b"},
+	}
+
+	stale := staleHeartbeats(heartbeats, ours, 10*time.Minute, now)
+	if len(stale) != 1 || stale[heartbeatTagKey("cluster")] == nil {
+		t.Errorf("Expected only the old heartbeat of the owner to be stale, got %v", stale)
+	}
+}
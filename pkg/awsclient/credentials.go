@@ -0,0 +1,104 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Session name used when assuming a role and none was configured.
+const defaultRoleSessionName = "aws-securitygroup-manager"
+
+// Optional settings for assuming an IAM role on top of whatever credentials
+// the SDK default chain resolves to.
+type AssumeRoleConfig struct {
+	RoleARN     string
+	ExternalID  string
+	SessionName string
+}
+
+// Load the AssumeRoleConfig from the environment. A nil result means that no
+// role should be assumed.
+func AssumeRoleConfigFromEnv() *AssumeRoleConfig {
+	roleARN := os.Getenv("AWS_SGMANAGER_ROLE_ARN")
+	if roleARN == "" {
+		return nil
+	}
+
+	sessionName := os.Getenv("AWS_SGMANAGER_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+
+	return &AssumeRoleConfig{
+		RoleARN:     roleARN,
+		ExternalID:  os.Getenv("AWS_SGMANAGER_EXTERNAL_ID"),
+		SessionName: sessionName,
+	}
+}
+
+// Create an AWS session using the SDK default credential chain. This covers
+// static env vars, shared config profiles (including SSO), EKS web identity
+// tokens and instance profiles. If assumeRole is given, the resolved
+// credentials are then used to assume that role.
+func newSession(assumeRole *AssumeRoleConfig) (*session.Session, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{},
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if assumeRole == nil {
+		return sess, nil
+	}
+
+	creds := assumeRoleCredentials(sess, assumeRole.RoleARN, assumeRole.ExternalID, assumeRole.SessionName)
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+// Build a set of credentials that assume roleARN using the credentials of
+// sess. The result caches the temporary credentials and refreshes them from
+// STS shortly before they expire.
+func assumeRoleCredentials(sess *session.Session, roleARN string, externalID string, sessionName string) *credentials.Credentials {
+	return stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = sessionName
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+	})
+}
+
+// Ask STS who the current credentials belong to. Useful for confirming at
+// startup that the expected identity was picked up by the credential chain.
+func (a *AwsContext) CallerIdentity(ctx context.Context) (string, error) {
+	output, err := sts.New(a.session).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("CallerIdentity error: %w", err)
+	}
+
+	return aws.StringValue(output.Arn), nil
+}
+
+// Get the AWS account of the credentials the SDK default chain resolves to,
+// without assuming any role.
+func DefaultAccountID(ctx context.Context) (string, error) {
+	sess, err := newSession(nil)
+	if err != nil {
+		return "", fmt.Errorf("DefaultAccountID error: %w", err)
+	}
+
+	output, err := sts.New(sess).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("DefaultAccountID error: %w", err)
+	}
+
+	return aws.StringValue(output.Account), nil
+}
@@ -0,0 +1,296 @@
+package awsclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The Description column in an AWS Security Group allows for arbitrary data.
+// We use that here to tag entries for ownership. Anything that is "owned" by
+// the current context is fair game while everything else is left alone.
+//
+// Descriptions are written in the v2 format, which is a version marker
+// followed by space separated key=value fields:
+//
+//	sgm/v2 owner=<owner id> node=<node name>
+//
+// Values are escaped so that any owner ID or node name survives the round
+// trip. The original v1 format is still understood when reading so that rules
+// written by older versions keep being recognized.
+const (
+	descriptionPrefixV2 = "sgm/v2"
+	descriptionFormatV1 = "ownerid=%s ; nodename=%s"
+)
+
+// Field names used in v2 descriptions.
+const (
+	descriptionOwnerKey = "owner"
+	descriptionNodeKey  = "node"
+)
+
+// AWS rejects descriptions longer than this.
+const maxDescriptionLength = 255
+
+// Marks a value that was too long and was replaced by (part of) its hash.
+const hashMarker = '#'
+
+// Number of hex characters of the SHA-256 hash kept for shortened values.
+const hashLength = 16
+
+// Characters that AWS allows in a rule description, other than letters and
+// digits. Space, '=', '$' and the hash marker are left out here because they
+// have a meaning in the v2 format, so they get escaped like anything else.
+const plainDescriptionCharacters = "._-:/()[],@+&;{}!*"
+
+// The parsed form of an ownership description.
+type Description struct {
+	// Format version the description was read from.
+	Version int
+
+	// Either the owner ID, or the hash token of an owner ID that was too
+	// long to be stored in full. Use MatchesOwner to compare.
+	OwnerID  string
+	NodeName string
+
+	// Any other fields of a v2 description, kept so that later additions
+	// to the format are not lost when a description is read and rewritten.
+	Fields map[string]string
+}
+
+// Check whether the description was written for ownerID.
+func (d *Description) MatchesOwner(ownerID string) bool {
+	return d.OwnerID == ownerID || d.OwnerID == hashToken(ownerID)
+}
+
+// Encode the description in the v2 format, shortening the node name and, if
+// the owner ID alone is too long, the owner ID until it fits within the AWS
+// length limit.
+func (d *Description) String() string {
+	return d.encode(nil)
+}
+
+// Encode the description like String does. If sign is given, a signature
+// field is added, computed by sign from the node name as it ends up being
+// stored after shortening.
+func (d *Description) encode(sign func(storedNodeName string) string) string {
+	extra := ""
+	keys := make([]string, 0)
+	for key := range d.Fields {
+		if sign != nil && key == signatureFieldName {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		extra += fmt.Sprintf(" %s=%s", escapeDescriptionValue(key), escapeDescriptionValue(d.Fields[key]))
+	}
+
+	// the signature has a fixed length, so a placeholder is enough to work
+	// out how much room is left for the other values
+	signature := strings.Repeat("0", signatureLength)
+	signatureField := ""
+	if sign != nil {
+		signatureField = fmt.Sprintf(" %s=%s", signatureFieldName, signature)
+	}
+
+	owner := escapeDescriptionValue(d.OwnerID)
+	node := escapeDescriptionValue(d.NodeName)
+	format := func() string {
+		return fmt.Sprintf("%s %s=%s %s=%s%s%s", descriptionPrefixV2, descriptionOwnerKey, owner,
+			descriptionNodeKey, node, extra, signatureField)
+	}
+
+	// the owner ID is only hashed when it doesn't fit next to even the
+	// shortest form of the node name, otherwise the node name is shortened
+	// for nothing
+	shortestNode := minInt(len(node), len(hashToken(d.NodeName)))
+	if overflow := len(format()) - maxDescriptionLength; overflow > len(node)-shortestNode {
+		owner = hashToken(d.OwnerID)
+	}
+	if overflow := len(format()) - maxDescriptionLength; overflow > 0 {
+		node = shortenValue(d.NodeName, node, len(node)-overflow)
+	}
+
+	if sign != nil {
+		storedNodeName, _ := unescapeDescriptionValue(node)
+		signatureField = fmt.Sprintf(" %s=%s", signatureFieldName, sign(storedNodeName))
+	}
+
+	return format()
+}
+
+// Create a "Description" according to the OwnerID and NodeName values.
+func (r *RuleEntry) GetDescription() string {
+	description := Description{OwnerID: r.OwnerID, NodeName: r.NodeName}
+	return description.String()
+}
+
+// Parse a description in either the v2 or the v1 format. nil is returned for
+// descriptions that aren't ownership markers at all.
+func ParseDescriptionFields(description *string) *Description {
+	if description == nil {
+		return nil
+	}
+
+	if strings.HasPrefix(*description, descriptionPrefixV2+" ") {
+		return parseDescriptionV2(*description)
+	}
+
+	var result Description
+	_, err := fmt.Sscanf(*description, descriptionFormatV1, &result.OwnerID, &result.NodeName)
+	if err != nil {
+		return nil
+	}
+	result.Version = 1
+
+	return &result
+}
+
+func parseDescriptionV2(description string) *Description {
+	result := Description{Version: 2, Fields: make(map[string]string)}
+	seenOwner := false
+
+	for _, field := range strings.Fields(strings.TrimPrefix(description, descriptionPrefixV2)) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+
+		key, err := unescapeDescriptionValue(parts[0])
+		if err != nil {
+			return nil
+		}
+		value, err := unescapeDescriptionValue(parts[1])
+		if err != nil {
+			return nil
+		}
+
+		switch key {
+		case descriptionOwnerKey:
+			result.OwnerID = value
+			seenOwner = true
+		case descriptionNodeKey:
+			result.NodeName = value
+		default:
+			result.Fields[key] = value
+		}
+	}
+
+	if !seenOwner || result.OwnerID == "" {
+		return nil
+	}
+
+	return &result
+}
+
+// Given the string found in the Description column of an inbound rule, get the
+// OwnerID and NodeName out of it.
+func ParseDescription(description *string) (*string, *string) {
+	parsed := ParseDescriptionFields(description)
+	if parsed == nil {
+		return nil, nil
+	}
+
+	return &parsed.OwnerID, &parsed.NodeName
+}
+
+// Create a RuleEntry from a Description string. Note that this will only fill up
+// the OwnerID and NodeName fields so the rest will still have to be filled up
+// after.
+func RuleEntryFromDescription(description *string) *RuleEntry {
+	parsed := ParseDescriptionFields(description)
+	if parsed == nil {
+		return nil
+	}
+
+	return &RuleEntry{OwnerID: parsed.OwnerID, NodeName: parsed.NodeName}
+}
+
+// Check whether a description marks its rule as owned by ownerID.
+func isDescriptionOwnedByID(description *string, ownerID string) bool {
+	parsed := ParseDescriptionFields(description)
+	return parsed != nil && parsed.MatchesOwner(ownerID)
+}
+
+// Escape a value so that it only uses characters AWS accepts and can't be
+// confused with the separators of the v2 format. Anything else is written as
+// '$' followed by the two digit hex code of each byte.
+func escapeDescriptionValue(value string) string {
+	var builder strings.Builder
+	for idx := 0; idx < len(value); idx++ {
+		c := value[idx]
+		if isPlainDescriptionCharacter(c) {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, "$%02X", c)
+		}
+	}
+
+	return builder.String()
+}
+
+func unescapeDescriptionValue(value string) (string, error) {
+	var builder strings.Builder
+	for idx := 0; idx < len(value); idx++ {
+		c := value[idx]
+		if c != '$' {
+			builder.WriteByte(c)
+			continue
+		}
+
+		if idx+2 >= len(value) {
+			return "", fmt.Errorf("Truncated escape sequence in '%s'", value)
+		}
+		code, err := strconv.ParseUint(value[idx+1:idx+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("Invalid escape sequence in '%s': %w", value, err)
+		}
+		builder.WriteByte(byte(code))
+		idx += 2
+	}
+
+	return builder.String(), nil
+}
+
+func isPlainDescriptionCharacter(c byte) bool {
+	return (c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') ||
+		strings.IndexByte(plainDescriptionCharacters, c) >= 0
+}
+
+// Shorten an escaped value to at most maxLength characters by keeping as much
+// of its start as possible and appending the hash of the full original value.
+// The hash keeps shortened values of different originals apart. Values that
+// already fit, or that the hash wouldn't make any shorter, are returned as
+// they are.
+func shortenValue(original string, escaped string, maxLength int) string {
+	token := hashToken(original)
+	if len(escaped) <= maxLength || len(escaped) <= len(token) {
+		return escaped
+	}
+
+	keep := maxLength - len(token)
+	if keep <= 0 {
+		return token
+	}
+
+	// don't cut an escape sequence in half
+	prefix := escaped[:keep]
+	if idx := strings.LastIndexByte(prefix, '$'); idx >= 0 && idx > len(prefix)-3 {
+		prefix = prefix[:idx]
+	}
+
+	return prefix + token
+}
+
+// The stand-in used for a value that is too long to store in full.
+func hashToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return string(hashMarker) + hex.EncodeToString(sum[:])[:hashLength]
+}
@@ -0,0 +1,133 @@
+package awsclient
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDescriptionRoundTrip(t *testing.T) {
+	validRules := []RuleEntry{
+		RuleEntry{NodeName: "node1", OwnerID: "cluster-a"},
+		RuleEntry{NodeName: "node with spaces", OwnerID: "owner with spaces"},
+		RuleEntry{NodeName: "node;1 ; nodename=x", OwnerID: "ownerid=y ; z"},
+		RuleEntry{NodeName: "nöde=1$2#3", OwnerID: "ownér%"},
+		RuleEntry{NodeName: "node1,node2,+3", OwnerID: "a"},
+	}
+
+	for _, rule := range validRules {
+		description := rule.GetDescription()
+		for idx := 0; idx < len(description); idx++ {
+			c := description[idx]
+			if c != ' ' && c != '=' && c != '$' && c != '#' && !isPlainDescriptionCharacter(c) {
+				t.Errorf("Description '%s' contains a character AWS doesn't allow: %q", description, c)
+			}
+		}
+
+		parsed := RuleEntryFromDescription(&description)
+		if parsed == nil || *parsed != rule {
+			t.Errorf("Description '%s' of rule %s parsed into %v", description, rule, parsed)
+		}
+	}
+}
+
+func TestDescriptionLength(t *testing.T) {
+	longNode := RuleEntry{NodeName: strings.Repeat("n", 300), OwnerID: "owner"}
+	description := longNode.GetDescription()
+	if len(description) > maxDescriptionLength {
+		t.Fatalf("Description is %d characters long", len(description))
+	}
+
+	parsed := ParseDescriptionFields(&description)
+	if parsed == nil || parsed.OwnerID != "owner" {
+		t.Fatalf("Description '%s' lost its owner", description)
+	}
+	if !strings.HasPrefix(parsed.NodeName, "nnnn") || !strings.HasSuffix(parsed.NodeName, hashToken(longNode.NodeName)) {
+		t.Errorf("Expected the node name to keep its start and end with its hash, got %s", parsed.NodeName)
+	}
+
+	otherNode := RuleEntry{NodeName: strings.Repeat("n", 299) + "m", OwnerID: "owner"}
+	if otherNode.GetDescription() == description {
+		t.Errorf("Different long node names produced the same description")
+	}
+
+	longOwner := RuleEntry{NodeName: "node", OwnerID: strings.Repeat("o", 300)}
+	description = longOwner.GetDescription()
+	if len(description) > maxDescriptionLength {
+		t.Fatalf("Description is %d characters long", len(description))
+	}
+	if !isDescriptionOwnedByID(&description, longOwner.OwnerID) {
+		t.Errorf("Description '%s' isn't recognized as owned by the long owner ID", description)
+	}
+	if isDescriptionOwnedByID(&description, strings.Repeat("o", 299)) {
+		t.Errorf("Description '%s' is recognized as owned by a different owner ID", description)
+	}
+	if parsed := ParseDescriptionFields(&description); parsed == nil || parsed.NodeName != "node" {
+		t.Errorf("Expected the short node name to survive a long owner ID, got '%s'", description)
+	}
+
+	bothLong := RuleEntry{NodeName: strings.Repeat("n", 60), OwnerID: strings.Repeat("o", 240)}
+	description = bothLong.GetDescription()
+	if len(description) > maxDescriptionLength {
+		t.Fatalf("Description is %d characters long", len(description))
+	}
+	parsed = ParseDescriptionFields(&description)
+	if parsed == nil || parsed.OwnerID != hashToken(bothLong.OwnerID) || parsed.NodeName != bothLong.NodeName {
+		t.Errorf("Expected the owner ID to be hashed and the node name kept, got '%s'", description)
+	}
+
+	mediumOwner := RuleEntry{NodeName: strings.Repeat("n", 300), OwnerID: strings.Repeat("o", 40)}
+	description = mediumOwner.GetDescription()
+	parsed = ParseDescriptionFields(&description)
+	if len(description) > maxDescriptionLength || parsed == nil || parsed.OwnerID != mediumOwner.OwnerID {
+		t.Errorf("Expected only the node name to be shortened, got '%s'", description)
+	}
+}
+
+func TestShortenValue(t *testing.T) {
+	if value := shortenValue("node", "node", -5); value != "node" {
+		t.Errorf("Expected a value shorter than a hash token to be kept, got %s", value)
+	}
+	if value := shortenValue("node-1", "node-1", 10); value != "node-1" {
+		t.Errorf("Expected a value that fits to be kept, got %s", value)
+	}
+
+	long := strings.Repeat("n", 40)
+	if value := shortenValue(long, long, 30); len(value) != 30 || !strings.HasSuffix(value, hashToken(long)) {
+		t.Errorf("Expected a shortened value of 30 characters ending in the hash, got %s", value)
+	}
+}
+
+func TestParseInvalidDescriptions(t *testing.T) {
+	invalidDescriptions := []string{
+		"",
+		"Testing rule",
+		"sgm/v2",
+		"sgm/v2 node=node1",
+		"sgm/v2 owner= node=node1",
+		"sgm/v2 owner=abc node=$4",
+		"sgm/v2 owner=abc node=$ZZ",
+		"sgm/v2 owner=abc garbage",
+	}
+
+	for _, description := range invalidDescriptions {
+		if parsed := ParseDescriptionFields(&description); parsed != nil {
+			t.Errorf("Expected '%s' not to parse, got %v", description, parsed)
+		}
+	}
+
+	if ParseDescriptionFields(nil) != nil {
+		t.Errorf("Expected a nil description not to parse")
+	}
+}
+
+func TestParseDescriptionKeepsUnknownFields(t *testing.T) {
+	description := "sgm/v2 owner=abc node=n1 future=some$20value"
+	parsed := ParseDescriptionFields(&description)
+	if parsed == nil || parsed.Fields["future"] != "some value" {
+		t.Fatalf("Unknown field wasn't kept: %v", parsed)
+	}
+
+	if parsed.String() != description {
+		t.Errorf("Expected '%s' to be written back unchanged, got '%s'", description, parsed.String())
+	}
+}
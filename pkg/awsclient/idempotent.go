@@ -0,0 +1,44 @@
+package awsclient
+
+import (
+	"fmt"
+)
+
+// Error codes EC2 fails a whole call with when a single rule in it is already
+// there, or already gone.
+const (
+	errCodeDuplicatePermission = "InvalidPermission.Duplicate"
+	errCodePermissionNotFound  = "InvalidPermission.NotFound"
+	errCodeRuleIDNotFound      = "InvalidSecurityGroupRuleId.NotFound"
+)
+
+// Check whether err comes from an AWS call that failed with code.
+func isAwsErrorCode(err error, code string) bool {
+	awsErr, ok := unwrapAwsError(err)
+	return ok && awsErr.Code() == code
+}
+
+// Apply a call to each of count rules on its own, after applying it to all of
+// them at once failed with the error code ignoredCode. apply(i) makes the call
+// for the i-th rule and name(i) names it in the log. A rule failing with
+// ignoredCode again is already in the wanted state and skipped. The remaining
+// rules are still applied when one fails otherwise, and the first such error
+// is returned.
+func applyEach(groupID string, count int, ignoredCode string, name func(i int) string, apply func(i int) error) error {
+	var result error
+	for i := 0; i < count; i++ {
+		err := apply(i)
+		if isAwsErrorCode(err, ignoredCode) {
+			fmt.Printf("Skipping %s in %s: %s\n", name(i), groupID, ignoredCode)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Warning: %s\n", err)
+			if result == nil {
+				result = err
+			}
+		}
+	}
+
+	return result
+}
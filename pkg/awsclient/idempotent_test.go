@@ -0,0 +1,49 @@
+package awsclient
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestApplyEach(t *testing.T) {
+	cidrs := []string{"10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32"}
+
+	applied := make([]string, 0)
+	apply := func(i int) error {
+		switch cidrs[i] {
+		case "10.0.0.1/32":
+			return fmt.Errorf("Error setting inbound rules: %w", awserr.New(errCodeDuplicatePermission, "already there", nil))
+		case "10.0.0.2/32":
+			return fmt.Errorf("Error setting inbound rules: %w", awserr.New("InvalidParameterValue", "bad rule", nil))
+		}
+
+		applied = append(applied, cidrs[i])
+		return nil
+	}
+	name := func(i int) string {
+		return cidrs[i]
+	}
+
+	err := applyEach("sg-1", len(cidrs), errCodeDuplicatePermission, name, apply)
+	if !isAwsErrorCode(err, "InvalidParameterValue") {
+		t.Errorf("Expected the InvalidParameterValue error, got %v", err)
+	}
+	if len(applied) != 1 || applied[0] != "10.0.0.3/32" {
+		t.Errorf("Expected the rules after the failed one to still be applied, got %v", applied)
+	}
+
+	ruleIDs := []string{"sgr-1", "sgr-gone", "sgr-2"}
+	err = applyEach("sg-1", len(ruleIDs), errCodeRuleIDNotFound, func(i int) string {
+		return ruleIDs[i]
+	}, func(i int) error {
+		if ruleIDs[i] == "sgr-gone" {
+			return awserr.New(errCodeRuleIDNotFound, "gone", nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected a missing rule to be skipped, got %s", err)
+	}
+}
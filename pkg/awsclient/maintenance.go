@@ -0,0 +1,31 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+)
+
+type removalsDeferredKey struct{}
+
+// Mark ctx so that replacements made with it only add and relabel rules.
+// Stale rules are left in place until a replacement without the mark, such
+// as the first one after a maintenance window.
+func WithRemovalsDeferred(ctx context.Context) context.Context {
+	return context.WithValue(ctx, removalsDeferredKey{}, true)
+}
+
+func removalsDeferredIn(ctx context.Context) bool {
+	deferred, _ := ctx.Value(removalsDeferredKey{}).(bool)
+	return deferred
+}
+
+// Check whether count removals from where should be skipped for now, and log
+// it if so.
+func (a *AwsContext) deferRemovals(ctx context.Context, where string, count int) bool {
+	if count == 0 || !removalsDeferredIn(ctx) {
+		return false
+	}
+
+	fmt.Printf("Deferring the removal of %d entries from %s until the maintenance window is over\n", count, where)
+	return true
+}
@@ -0,0 +1,22 @@
+package awsclient
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDeferRemovals(t *testing.T) {
+	var a AwsContext
+	ctx := context.Background()
+	if a.deferRemovals(ctx, "sg-1", 3) {
+		t.Errorf("Expected removals to go ahead outside of a maintenance window")
+	}
+
+	ctx = WithRemovalsDeferred(ctx)
+	if !a.deferRemovals(ctx, "sg-1", 3) {
+		t.Errorf("Expected removals to be deferred")
+	}
+	if a.deferRemovals(ctx, "sg-1", 0) {
+		t.Errorf("Expected nothing to be deferred without removals")
+	}
+}
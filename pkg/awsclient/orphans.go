@@ -0,0 +1,394 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Every reconcile tags the managed security group with a heartbeat for its
+// owner ID. The key is this prefix followed by the hex part of the owner's
+// hash token, so that it fits the tag key limits whatever the owner ID looks
+// like, and so that it can also be found for owners that were shortened to
+// their hash token in descriptions. Known instances add a slash and the hex
+// part of the hash token of their instance ID, so that every instance of an
+// owner has a heartbeat of its own.
+const HeartbeatTagPrefix = "aws-securitygroup-manager/heartbeat/"
+
+// Owners whose heartbeat is older than this are considered gone unless
+// AWS_SGMANAGER_HEARTBEAT_TTL says otherwise.
+const defaultHeartbeatTTL = 24 * time.Hour
+
+// States an owner found in a security group can be in.
+const (
+	OwnerAlive   = "alive"
+	OwnerExpired = "expired"
+
+	// Owners with rules but without any heartbeat, such as ones written
+	// by versions that didn't send heartbeats yet.
+	OwnerMissing = "missing"
+)
+
+// Load the heartbeat TTL from AWS_SGMANAGER_HEARTBEAT_TTL.
+func HeartbeatTTLFromEnv() (time.Duration, error) {
+	value := os.Getenv("AWS_SGMANAGER_HEARTBEAT_TTL")
+	if value == "" {
+		return defaultHeartbeatTTL, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("Invalid AWS_SGMANAGER_HEARTBEAT_TTL value: %s", value)
+	}
+
+	return ttl, nil
+}
+
+// The tag key holding the heartbeat of ownerID, which may also be the hash
+// token of an owner ID.
+func heartbeatTagKey(ownerID string) string {
+	token := ownerID
+	if len(token) == 0 || token[0] != hashMarker {
+		token = hashToken(ownerID)
+	}
+
+	return HeartbeatTagPrefix + token[1:]
+}
+
+// The tag key holding the heartbeat of one instance of ownerID. Unknown
+// instances share the key of the owner.
+func instanceHeartbeatTagKey(ownerID string, instanceID string) string {
+	if instanceID == "" {
+		return heartbeatTagKey(ownerID)
+	}
+
+	return heartbeatTagKey(ownerID) + "/" + hashToken(instanceID)[1:]
+}
+
+// Get the heartbeats of every instance of ownerID, by tag key.
+func heartbeatsOf(heartbeats map[string]*heartbeat, ownerID string) map[string]*heartbeat {
+	ownerKey := heartbeatTagKey(ownerID)
+	results := make(map[string]*heartbeat)
+	for key, beat := range heartbeats {
+		if key == ownerKey || strings.HasPrefix(key, ownerKey+"/") {
+			results[key] = beat
+		}
+	}
+
+	return results
+}
+
+// Get the most recent of heartbeats, or nil if there are none.
+func latestHeartbeat(heartbeats map[string]*heartbeat) *heartbeat {
+	var latest *heartbeat
+	for _, beat := range heartbeats {
+		if latest == nil || beat.Time.After(latest.Time) {
+			latest = beat
+		}
+	}
+
+	return latest
+}
+
+// The last sign of life of an owner, stored as the value of its heartbeat
+// tag: the time, followed by the instance that wrote it if known.
+type heartbeat struct {
+	Time       time.Time
+	InstanceID string
+}
+
+func (h *heartbeat) String() string {
+	value := h.Time.UTC().Format(time.RFC3339)
+	if h.InstanceID != "" {
+		value += " instance=" + h.InstanceID
+	}
+
+	return value
+}
+
+// Parse the value of a heartbeat tag written by heartbeat.String.
+func parseHeartbeat(value string) (*heartbeat, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Empty heartbeat")
+	}
+
+	var result heartbeat
+	var err error
+	result.Time, err = time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid heartbeat time %s: %w", fields[0], err)
+	}
+
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "instance=") {
+			result.InstanceID = strings.TrimPrefix(field, "instance=")
+		}
+	}
+
+	return &result, nil
+}
+
+// The ID of the security group or prefix list this context manages.
+func (a *AwsContext) targetResourceID() string {
+	if a.Target.PrefixListID != "" {
+		return a.Target.PrefixListID
+	}
+
+	return a.SecurityGroupID
+}
+
+// Record that this instance of the owner is still around by tagging the
+// managed security group or prefix list with the current time and instance.
+func (a *AwsContext) writeHeartbeat(ctx context.Context) error {
+	beat := heartbeat{Time: time.Now(), InstanceID: a.InstanceID}
+	_, err := a.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(a.targetResourceID())},
+		Tags: []*ec2.Tag{
+			&ec2.Tag{
+				Key:   aws.String(instanceHeartbeatTagKey(a.OwnerID, a.InstanceID)),
+				Value: aws.String(beat.String()),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing heartbeat to %s: %w", a.targetResourceID(), err)
+	}
+
+	return nil
+}
+
+// The rules of one owner found in a security group and its overflow groups.
+type OwnerReport struct {
+	OwnerID       string
+	State         string
+	LastHeartbeat time.Time
+
+	// Rule IDs by security group.
+	Rules map[string][]string
+}
+
+// Count the rules of the owner over all groups.
+func (o *OwnerReport) RuleCount() int {
+	count := 0
+	for _, ruleIDs := range o.Rules {
+		count += len(ruleIDs)
+	}
+
+	return count
+}
+
+// Find every owner that has rules in the security group or its overflow groups
+// and check their heartbeats. Rules without any ownership marker aren't
+// reported. The current owner is always reported as alive.
+func (a *AwsContext) ScanOwners(ctx context.Context, ttl time.Duration) ([]*OwnerReport, error) {
+	if a.Target.PrefixListID != "" {
+		return nil, fmt.Errorf("ScanOwners error: prefix list targets aren't supported")
+	}
+
+	heartbeats, err := a.getHeartbeats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ScanOwners error: %w", err)
+	}
+
+	groupIDs, err := a.getPoolGroupIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ScanOwners error: %w", err)
+	}
+
+	tags := &tagOwnership{a}
+	rulesByOwner := make(map[string]map[string][]string)
+	for _, groupID := range groupIDs {
+		state, err := tags.getGroupState(ctx, groupID)
+		if err != nil {
+			return nil, fmt.Errorf("ScanOwners error: %w", err)
+		}
+
+		for _, rule := range state.rules {
+			ownerID := ruleOwnerID(rule)
+			if ownerID == "" {
+				continue
+			}
+			if rulesByOwner[ownerID] == nil {
+				rulesByOwner[ownerID] = make(map[string][]string)
+			}
+			rulesByOwner[ownerID][groupID] = append(rulesByOwner[ownerID][groupID], aws.StringValue(rule.SecurityGroupRuleId))
+		}
+	}
+
+	return reportOwners(rulesByOwner, heartbeats, a.OwnerID, ttl, time.Now()), nil
+}
+
+// Build the sorted owner reports from the rules found for each owner and the
+// heartbeats by tag key. The most recent heartbeat of any instance of an owner
+// counts.
+func reportOwners(rulesByOwner map[string]map[string][]string, heartbeats map[string]*heartbeat, currentOwnerID string, ttl time.Duration, now time.Time) []*OwnerReport {
+	reports := make([]*OwnerReport, 0)
+	for ownerID, rules := range rulesByOwner {
+		report := OwnerReport{OwnerID: ownerID, Rules: rules}
+		beat := latestHeartbeat(heartbeatsOf(heartbeats, ownerID))
+		if beat != nil {
+			report.LastHeartbeat = beat.Time
+		}
+
+		switch {
+		case (&Description{OwnerID: ownerID}).MatchesOwner(currentOwnerID):
+			report.State = OwnerAlive
+		case beat == nil:
+			report.State = OwnerMissing
+		case now.Sub(beat.Time) > ttl:
+			report.State = OwnerExpired
+		default:
+			report.State = OwnerAlive
+		}
+
+		reports = append(reports, &report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].OwnerID < reports[j].OwnerID
+	})
+	return reports
+}
+
+// Get the owner a security group rule is marked with, by tag or by
+// description.
+func ruleOwnerID(rule *ec2.SecurityGroupRule) string {
+	if entry := ruleEntryFromTaggedRule(rule); entry != nil {
+		return entry.OwnerID
+	}
+
+	if parsed := ParseDescriptionFields(rule.Description); parsed != nil {
+		return parsed.OwnerID
+	}
+
+	return ""
+}
+
+// Read the heartbeat tags of the managed security group or prefix list.
+func (a *AwsContext) getHeartbeats(ctx context.Context) (map[string]*heartbeat, error) {
+	var tags []*ec2.Tag
+	if a.Target.PrefixListID != "" {
+		output, err := a.ec2.DescribeManagedPrefixListsWithContext(ctx, &ec2.DescribeManagedPrefixListsInput{
+			PrefixListIds: []*string{aws.String(a.Target.PrefixListID)},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error describing prefix list %s: %w", a.Target.PrefixListID, err)
+		}
+		if len(output.PrefixLists) == 0 {
+			return nil, fmt.Errorf("Prefix list %s not found", a.Target.PrefixListID)
+		}
+		tags = output.PrefixLists[0].Tags
+	} else {
+		output, err := a.ec2.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+			GroupIds: []*string{aws.String(a.SecurityGroupID)},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error describing %s: %w", a.SecurityGroupID, err)
+		}
+		if len(output.SecurityGroups) == 0 {
+			return nil, fmt.Errorf("Security group %s not found", a.SecurityGroupID)
+		}
+		tags = output.SecurityGroups[0].Tags
+	}
+
+	results := make(map[string]*heartbeat)
+	for _, tag := range tags {
+		key := aws.StringValue(tag.Key)
+		if !strings.HasPrefix(key, HeartbeatTagPrefix) {
+			continue
+		}
+
+		beat, err := parseHeartbeat(aws.StringValue(tag.Value))
+		if err != nil {
+			fmt.Printf("Warning: ignoring heartbeat %s on %s: %s\n", key, a.targetResourceID(), err)
+			continue
+		}
+		results[key] = beat
+	}
+
+	return results, nil
+}
+
+// Remove every rule of an owner found by ScanOwners, along with its
+// heartbeat. The rules are snapshotted first if a snapshot store is
+// configured.
+func (a *AwsContext) DeleteOwnerRules(ctx context.Context, report *OwnerReport) error {
+	ctx, flushAudit := a.bufferAudit(ctx)
+	defer flushAudit()
+
+	if (&Description{OwnerID: report.OwnerID}).MatchesOwner(a.OwnerID) {
+		return fmt.Errorf("DeleteOwnerRules error: refusing to delete the rules of the current owner %s", a.OwnerID)
+	}
+
+	pool, err := a.getGroupPool(ctx)
+	if err != nil {
+		return fmt.Errorf("DeleteOwnerRules error: %w", err)
+	}
+
+	err = a.snapshotPool(ctx, pool, false)
+	if err != nil {
+		return fmt.Errorf("DeleteOwnerRules error while saving a snapshot: %w", err)
+	}
+
+	tags := &tagOwnership{a}
+	groupIDs := make([]string, 0)
+	for groupID := range report.Rules {
+		groupIDs = append(groupIDs, groupID)
+	}
+	sort.Strings(groupIDs)
+
+	for _, groupID := range groupIDs {
+		err = tags.revokeRuleIDs(ctx, groupID, aws.StringSlice(report.Rules[groupID]))
+		if err != nil {
+			return fmt.Errorf("DeleteOwnerRules error: %w", err)
+		}
+	}
+
+	heartbeats, err := a.getHeartbeats(ctx)
+	if err != nil {
+		return fmt.Errorf("DeleteOwnerRules error: %w", err)
+	}
+
+	err = a.deleteHeartbeats(ctx, heartbeatsOf(heartbeats, report.OwnerID))
+	if err != nil {
+		return fmt.Errorf("DeleteOwnerRules error while removing the heartbeats of %s: %w", report.OwnerID, err)
+	}
+
+	return nil
+}
+
+// Remove the heartbeat tags with the keys of heartbeats from the managed
+// security group or prefix list.
+func (a *AwsContext) deleteHeartbeats(ctx context.Context, heartbeats map[string]*heartbeat) error {
+	if len(heartbeats) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0)
+	for key := range heartbeats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tags := make([]*ec2.Tag, 0)
+	for _, key := range keys {
+		tags = append(tags, &ec2.Tag{Key: aws.String(key)})
+	}
+
+	_, err := a.ec2.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(a.targetResourceID())},
+		Tags:      tags,
+	})
+	if err != nil {
+		return fmt.Errorf("Error removing heartbeats from %s: %w", a.targetResourceID(), err)
+	}
+
+	return nil
+}
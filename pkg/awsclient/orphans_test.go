@@ -0,0 +1,121 @@
+package awsclient
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestHeartbeatTagKey(t *testing.T) {
+	ownerID := strings.Repeat("cluster", 40)
+	key := heartbeatTagKey(ownerID)
+	if !strings.HasPrefix(key, HeartbeatTagPrefix) || len(key) > 128 {
+		t.Errorf("Unexpected heartbeat tag key %s", key)
+	}
+
+	if heartbeatTagKey(hashToken(ownerID)) != key {
+		t.Errorf("Expected the hash token of %s to have the same heartbeat tag key", ownerID)
+	}
+
+	instanceKey := instanceHeartbeatTagKey(ownerID, "4f1c2d3e-uid")
+	if !strings.HasPrefix(instanceKey, key+"/") || len(instanceKey) > 128 {
+		t.Errorf("Unexpected instance heartbeat tag key %s", instanceKey)
+	}
+	if instanceHeartbeatTagKey(ownerID, "") != key {
+		t.Errorf("Expected unknown instances to use the heartbeat tag key of the owner")
+	}
+
+	heartbeats := map[string]*heartbeat{
+		key:                      &heartbeat{},
+		instanceKey:              &heartbeat{},
+		heartbeatTagKey("other"): &heartbeat{},
+		instanceHeartbeatTagKey("other", "4f1c2d3e-uid"): &heartbeat{},
+	}
+	owned := heartbeatsOf(heartbeats, ownerID)
+	if len(owned) != 2 || owned[key] == nil || owned[instanceKey] == nil {
+		t.Errorf("Expected the heartbeats of both instances of %s, got %v", ownerID, owned)
+	}
+}
+
+func TestParseHeartbeat(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, beat := range []*heartbeat{&heartbeat{Time: now}, &heartbeat{Time: now, InstanceID: "4f1c2d3e-uid"}} {
+		parsed, err := parseHeartbeat(beat.String())
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %s", beat, err)
+			continue
+		}
+		if !parsed.Time.Equal(beat.Time) || parsed.InstanceID != beat.InstanceID {
+			t.Errorf("Expected %s, got %s", beat, parsed)
+		}
+	}
+
+	for _, value := range []string{"", "yesterday", "instance=abc"} {
+		if _, err := parseHeartbeat(value); err == nil {
+			t.Errorf("Expected an error parsing %q", value)
+		}
+	}
+}
+
+func TestReportOwners(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	rulesByOwner := map[string]map[string][]string{
+		"current": {"sg-1": {"sgr-1"}},
+		"alive":   {"sg-1": {"sgr-2"}},
+		"expired": {"sg-1": {"sgr-3"}, "sg-2": {"sgr-4", "sgr-5"}},
+		"missing": {"sg-2": {"sgr-6"}},
+	}
+	heartbeats := map[string]*heartbeat{
+		instanceHeartbeatTagKey("alive", "uid-a"): &heartbeat{Time: now.Add(-48 * time.Hour)},
+		instanceHeartbeatTagKey("alive", "uid-b"): &heartbeat{Time: now.Add(-time.Hour)},
+		heartbeatTagKey("expired"):                &heartbeat{Time: now.Add(-48 * time.Hour)},
+	}
+
+	reports := reportOwners(rulesByOwner, heartbeats, "current", 24*time.Hour, now)
+	states := make(map[string]string)
+	order := make([]string, 0)
+	for _, report := range reports {
+		states[report.OwnerID] = report.State
+		order = append(order, report.OwnerID)
+	}
+
+	expected := map[string]string{"current": OwnerAlive, "alive": OwnerAlive, "expired": OwnerExpired, "missing": OwnerMissing}
+	for ownerID, state := range expected {
+		if states[ownerID] != state {
+			t.Errorf("Expected %s to be %s, got %s", ownerID, state, states[ownerID])
+		}
+	}
+
+	if strings.Join(order, ",") != "alive,current,expired,missing" {
+		t.Errorf("Unexpected report order %v", order)
+	}
+
+	if reports[2].RuleCount() != 3 {
+		t.Errorf("Expected 3 rules for expired, got %d", reports[2].RuleCount())
+	}
+}
+
+func TestRuleOwnerID(t *testing.T) {
+	tagged := &ec2.SecurityGroupRule{
+		CidrIpv4: aws.String("10.0.0.1/32"),
+		Tags:     []*ec2.Tag{&ec2.Tag{Key: aws.String(OwnerTagKey), Value: aws.String("tagged")}},
+	}
+	described := &ec2.SecurityGroupRule{
+		CidrIpv4:    aws.String("10.0.0.2/32"),
+		Description: aws.String((&Description{OwnerID: "described", NodeName: "node"}).String()),
+	}
+	unmarked := &ec2.SecurityGroupRule{CidrIpv4: aws.String("10.0.0.3/32"), Description: aws.String("office")}
+
+	if owner := ruleOwnerID(tagged); owner != "tagged" {
+		t.Errorf("Expected owner tagged, got %s", owner)
+	}
+	if owner := ruleOwnerID(described); owner != "described" {
+		t.Errorf("Expected owner described, got %s", owner)
+	}
+	if owner := ruleOwnerID(unmarked); owner != "" {
+		t.Errorf("Expected no owner, got %s", owner)
+	}
+}
@@ -0,0 +1,509 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Ways of recording which rules are owned by which OwnerID.
+const (
+	// Ownership is recorded in the rule description. This works
+	// everywhere but anyone who edits a description in the console can
+	// transfer or drop ownership by accident.
+	OwnershipDescription = "description"
+
+	// Ownership is recorded in tags on the individual security group
+	// rules, which aren't as easily edited by accident. The description
+	// marker is still written, but only for information.
+	OwnershipTags = "tags"
+)
+
+// Tags used on security group rules by the tags ownership mode.
+const (
+	OwnerTagKey = "aws-securitygroup-manager/owner"
+	NodeTagKey  = "aws-securitygroup-manager/node"
+)
+
+// Load the ownership mode from AWS_SGMANAGER_OWNERSHIP, defaulting to
+// descriptions.
+func OwnershipModeFromEnv() (string, error) {
+	mode := os.Getenv("AWS_SGMANAGER_OWNERSHIP")
+	switch mode {
+	case "":
+		return OwnershipDescription, nil
+	case OwnershipDescription, OwnershipTags:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("Invalid AWS_SGMANAGER_OWNERSHIP value: %s", mode)
+	}
+}
+
+// Load the time until which rules without owner tags are still judged by
+// their description marker in the tags mode, from
+// AWS_SGMANAGER_TAGS_MIGRATION_UNTIL. The zero time, the default, judges them
+// by their tags alone.
+func TagsMigrationFromEnv() (time.Time, error) {
+	value := os.Getenv("AWS_SGMANAGER_TAGS_MIGRATION_UNTIL")
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid AWS_SGMANAGER_TAGS_MIGRATION_UNTIL value: %s", value)
+	}
+
+	return until, nil
+}
+
+// What a security group currently looks like from the point of view of one
+// OwnerID.
+type groupState struct {
+	GroupID string
+
+	// The entries currently owned by us.
+	Owned []*RuleEntry
+
+	// Number of rules in the group that aren't owned by us.
+	ForeignRules int
+
+	// Rules that claim to be ours but whose signature doesn't check out.
+	// These are counted as foreign rules and left alone.
+	Spoofed []string
+
+	// The raw rules, in whichever form the ownership backend works with.
+	permissions []*ec2.IpPermission
+	rules       []*ec2.SecurityGroupRule
+}
+
+// Reads and writes owned entries of a security group according to one way of
+// recording ownership.
+type ownershipBackend interface {
+	getGroupState(ctx context.Context, groupID string) (*groupState, error)
+	replaceOwnedEntries(ctx context.Context, state *groupState, entries []*RuleEntry) error
+
+	// Add rules for entries that aren't in the group yet, and remove the
+	// owned rules matching entries. These are used to apply a saved plan.
+	authorizeEntries(ctx context.Context, state *groupState, entries []*RuleEntry) error
+	revokeEntries(ctx context.Context, state *groupState, entries []*RuleEntry) error
+}
+
+// Get the ownership backend matching the configured mode.
+func (a *AwsContext) ownership() ownershipBackend {
+	if a.Ownership == OwnershipTags {
+		return &tagOwnership{a}
+	}
+
+	return &descriptionOwnership{a}
+}
+
+type descriptionOwnership struct {
+	a *AwsContext
+}
+
+func (d *descriptionOwnership) getGroupState(ctx context.Context, groupID string) (*groupState, error) {
+	permissions, err := d.a.getInboundRules(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	return descriptionGroupState(groupID, permissions, d.a.identity()), nil
+}
+
+func descriptionGroupState(groupID string, permissions []*ec2.IpPermission, owner *ownerIdentity) *groupState {
+	owned := filterInboundRules(permissions, owner, true)
+	state := groupState{
+		GroupID:      groupID,
+		Owned:        ruleEntriesFromOwnedRules(owned),
+		ForeignRules: countRules(permissions) - countRules(owned),
+		permissions:  permissions,
+	}
+
+	for _, rule := range expandRules(permissions) {
+		if classifyRule(rule, owner) == ruleSpoofed {
+			state.Spoofed = append(state.Spoofed, permissionKey(rule))
+		}
+	}
+
+	return &state
+}
+
+func (d *descriptionOwnership) replaceOwnedEntries(ctx context.Context, state *groupState, entries []*RuleEntry) error {
+	return d.a.replaceOwnedEntriesInGroup(ctx, state.GroupID, state.permissions, entries)
+}
+
+func (d *descriptionOwnership) authorizeEntries(ctx context.Context, state *groupState, entries []*RuleEntry) error {
+	return d.a.setInboundRules(ctx, state.GroupID, d.a.ruleEntriesToIpPermissions(entries))
+}
+
+func (d *descriptionOwnership) revokeEntries(ctx context.Context, state *groupState, entries []*RuleEntry) error {
+	keys := make(map[string]bool)
+	for _, entry := range entries {
+		keys[entry.key()] = true
+	}
+
+	// the rules are revoked exactly as they were read so that nothing but
+	// the owned rules can match
+	rules := make([]*ec2.IpPermission, 0)
+	for _, rule := range filterInboundRules(state.permissions, d.a.identity(), true) {
+		if keys[permissionKey(rule)] {
+			rules = append(rules, rule)
+		}
+	}
+
+	return d.a.deleteInboundRules(ctx, state.GroupID, rules)
+}
+
+type tagOwnership struct {
+	a *AwsContext
+}
+
+func (t *tagOwnership) getGroupState(ctx context.Context, groupID string) (*groupState, error) {
+	input := &ec2.DescribeSecurityGroupRulesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{Name: aws.String("group-id"), Values: []*string{aws.String(groupID)}},
+		},
+	}
+
+	rules := make([]*ec2.SecurityGroupRule, 0)
+	err := t.a.ec2.DescribeSecurityGroupRulesPagesWithContext(ctx, input, func(page *ec2.DescribeSecurityGroupRulesOutput, lastPage bool) bool {
+		for _, rule := range page.SecurityGroupRules {
+			if !aws.BoolValue(rule.IsEgress) {
+				rules = append(rules, rule)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting rules of %s: %w", groupID, err)
+	}
+
+	return tagGroupState(groupID, rules, t.a.identity()), nil
+}
+
+func tagGroupState(groupID string, rules []*ec2.SecurityGroupRule, owner *ownerIdentity) *groupState {
+	state := groupState{GroupID: groupID, Owned: make([]*RuleEntry, 0), rules: rules}
+	for _, rule := range rules {
+		switch owner.classifyTaggedRule(rule) {
+		case ruleOwned:
+			// a description marker may only carry the hash of our ID
+			entry := ruleEntryFromTaggedRule(rule)
+			entry.OwnerID = owner.ID
+			state.Owned = append(state.Owned, entry)
+		case ruleSpoofed:
+			state.Spoofed = append(state.Spoofed, aws.StringValue(rule.SecurityGroupRuleId))
+			state.ForeignRules++
+		default:
+			state.ForeignRules++
+		}
+	}
+
+	return &state
+}
+
+// Create a RuleEntry from a rule carrying ownership tags, or from its
+// description marker if it has no owner tag. nil is returned for rules without
+// either or without a CIDR source.
+func ruleEntryFromTaggedRule(rule *ec2.SecurityGroupRule) *RuleEntry {
+	var result RuleEntry
+	if hasOwnerTag(rule) {
+		for _, tag := range rule.Tags {
+			switch aws.StringValue(tag.Key) {
+			case OwnerTagKey:
+				result.OwnerID = aws.StringValue(tag.Value)
+			case NodeTagKey:
+				result.NodeName = aws.StringValue(tag.Value)
+			}
+		}
+	} else if parsed := ParseDescriptionFields(rule.Description); parsed != nil {
+		result.OwnerID = parsed.OwnerID
+		result.NodeName = parsed.NodeName
+	}
+
+	result.IP = ruleCidr(rule)
+	if result.OwnerID == "" || result.IP == "" {
+		return nil
+	}
+
+	result.Protocol = aws.StringValue(rule.IpProtocol)
+	result.FromPort = aws.Int64Value(rule.FromPort)
+	result.ToPort = aws.Int64Value(rule.ToPort)
+	return &result
+}
+
+// Check whether a rule carries an owner tag. Rules created in the description
+// mode don't until they are tagged in place.
+func hasOwnerTag(rule *ec2.SecurityGroupRule) bool {
+	for _, tag := range rule.Tags {
+		if aws.StringValue(tag.Key) == OwnerTagKey {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the CIDR source of a rule, or an empty string if it has another kind
+// of source.
+func ruleCidr(rule *ec2.SecurityGroupRule) string {
+	if rule.CidrIpv4 != nil {
+		return aws.StringValue(rule.CidrIpv4)
+	}
+
+	return aws.StringValue(rule.CidrIpv6)
+}
+
+// Bring the owned rules in line with entries. Unlike the description mode
+// this only touches the rules that actually change. New rules are added
+// before old ones are removed so that access is never interrupted.
+func (t *tagOwnership) replaceOwnedEntries(ctx context.Context, state *groupState, entries []*RuleEntry) error {
+	owner := t.a.identity()
+	owned := make(map[string]*ec2.SecurityGroupRule)
+	foreign := make(map[string]bool)
+	for _, rule := range state.rules {
+		key := securityGroupRuleKey(rule)
+		if owner.classifyTaggedRule(rule) == ruleOwned {
+			owned[key] = rule
+		} else {
+			foreign[key] = true
+		}
+	}
+
+	wanted := make(map[string]bool)
+	newEntries := make([]*RuleEntry, 0)
+	for _, entry := range entries {
+		key := entry.key()
+		if wanted[key] {
+			continue
+		}
+		wanted[key] = true
+
+		rule, ok := owned[key]
+		if !ok {
+			if foreign[key] {
+				fmt.Printf("Skipping %s, %s already has a rule for it that isn't ours\n", entry, state.GroupID)
+				continue
+			}
+
+			newEntries = append(newEntries, entry)
+			continue
+		}
+
+		// rules only marked by their description, like those created
+		// before switching to the tags mode, are tagged in place
+		existing := ruleEntryFromTaggedRule(rule)
+		if !hasOwnerTag(rule) || existing.NodeName != entry.NodeName || !owner.hasCurrentSignature(rule, entry) {
+			err := t.updateMarker(ctx, state.GroupID, rule, entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := t.authorizeEntries(ctx, state, newEntries)
+	if err != nil {
+		return err
+	}
+
+	staleRuleIDs := make([]*string, 0)
+	for key, rule := range owned {
+		if !wanted[key] {
+			staleRuleIDs = append(staleRuleIDs, rule.SecurityGroupRuleId)
+		}
+	}
+
+	if t.a.deferRemovals(ctx, state.GroupID, len(staleRuleIDs)) {
+		return nil
+	}
+
+	return t.revokeRuleIDs(ctx, state.GroupID, staleRuleIDs)
+}
+
+func (t *tagOwnership) authorizeEntries(ctx context.Context, state *groupState, entries []*RuleEntry) error {
+	// the tags of a new rule apply to every rule in the same call, so
+	// rules are added in sets that share the same tags
+	owner := t.a.identity()
+	entriesByTags := make(map[string][]*RuleEntry)
+	tagsOrder := make([]string, 0)
+	for _, entry := range entries {
+		tagsKey := fmt.Sprint(owner.tagsFor(entry))
+		if _, seen := entriesByTags[tagsKey]; !seen {
+			tagsOrder = append(tagsOrder, tagsKey)
+		}
+		entriesByTags[tagsKey] = append(entriesByTags[tagsKey], entry)
+	}
+
+	for _, tagsKey := range tagsOrder {
+		err := t.authorizeTagged(ctx, state.GroupID, entriesByTags[tagsKey])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *tagOwnership) revokeEntries(ctx context.Context, state *groupState, entries []*RuleEntry) error {
+	keys := make(map[string]bool)
+	for _, entry := range entries {
+		keys[entry.key()] = true
+	}
+
+	owner := t.a.identity()
+	ruleIDs := make([]*string, 0)
+	for _, rule := range state.rules {
+		if keys[securityGroupRuleKey(rule)] && owner.classifyTaggedRule(rule) == ruleOwned {
+			ruleIDs = append(ruleIDs, rule.SecurityGroupRuleId)
+		}
+	}
+
+	return t.revokeRuleIDs(ctx, state.GroupID, ruleIDs)
+}
+
+func (t *tagOwnership) revokeRuleIDs(ctx context.Context, groupID string, ruleIDs []*string) error {
+	if len(ruleIDs) == 0 {
+		return nil
+	}
+
+	return t.a.inBatches(groupID, "Revoke", len(ruleIDs), func(start int, end int) error {
+		batch := ruleIDs[start:end]
+		err := t.revokeRuleIDsCall(ctx, groupID, batch)
+		if isAwsErrorCode(err, errCodeRuleIDNotFound) && len(batch) > 1 {
+			// one of the rules is already gone, which fails all of them
+			return applyEach(groupID, len(batch), errCodeRuleIDNotFound, func(i int) string {
+				return aws.StringValue(batch[i])
+			}, func(i int) error {
+				return t.revokeRuleIDsCall(ctx, groupID, batch[i:i+1])
+			})
+		}
+
+		return err
+	})
+}
+
+func (t *tagOwnership) revokeRuleIDsCall(ctx context.Context, groupID string, ruleIDs []*string) error {
+	var requestID string
+	_, err := t.a.ec2.RevokeSecurityGroupIngressWithContext(ctx, &ec2.RevokeSecurityGroupIngressInput{
+		GroupId:              aws.String(groupID),
+		SecurityGroupRuleIds: ruleIDs,
+	}, captureRequestID(&requestID))
+	t.a.audit(ctx, groupID, AuditRevoke, nil, aws.StringValueSlice(ruleIDs), requestID, err)
+	if err != nil {
+		return fmt.Errorf("Error deleting inbound rules from %s: %w", groupID, err)
+	}
+
+	return nil
+}
+
+// Add rules for entries that all share the same ownership tags, tagging them
+// as they are created so that they are never unowned.
+func (t *tagOwnership) authorizeTagged(ctx context.Context, groupID string, entries []*RuleEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return t.a.inBatches(groupID, "Authorize", len(entries), func(start int, end int) error {
+		return t.authorizeTaggedBatch(ctx, groupID, entries[start:end])
+	})
+}
+
+func (t *tagOwnership) authorizeTaggedBatch(ctx context.Context, groupID string, entries []*RuleEntry) error {
+	err := t.authorizeTaggedCall(ctx, groupID, entries)
+	if !isAwsErrorCode(err, errCodeDuplicatePermission) || len(entries) == 1 {
+		return err
+	}
+
+	// one of the rules is already there, which fails all of them
+	return applyEach(groupID, len(entries), errCodeDuplicatePermission, func(i int) string {
+		return entries[i].key()
+	}, func(i int) error {
+		return t.authorizeTaggedCall(ctx, groupID, entries[i:i+1])
+	})
+}
+
+func (t *tagOwnership) authorizeTaggedCall(ctx context.Context, groupID string, entries []*RuleEntry) error {
+	input := &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(groupID),
+		IpPermissions: t.a.ruleEntriesToIpPermissions(entries),
+		TagSpecifications: []*ec2.TagSpecification{
+			&ec2.TagSpecification{
+				ResourceType: aws.String(ec2.ResourceTypeSecurityGroupRule),
+				Tags:         t.a.identity().tagsFor(entries[0]),
+			},
+		},
+	}
+
+	var requestID string
+	_, err := t.a.ec2.AuthorizeSecurityGroupIngressWithContext(ctx, input, captureRequestID(&requestID))
+	t.a.audit(ctx, groupID, AuditAuthorize, auditRules(input.IpPermissions), nil, requestID, err)
+	if err != nil {
+		return fmt.Errorf("Error setting inbound rules on %s: %w", groupID, err)
+	}
+
+	return nil
+}
+
+// Point an existing rule at the owner and node name of entry, both in its
+// tags and in its informational description.
+func (t *tagOwnership) updateMarker(ctx context.Context, groupID string, rule *ec2.SecurityGroupRule, entry *RuleEntry) error {
+	ruleID := aws.StringValue(rule.SecurityGroupRuleId)
+	description := t.a.identity().descriptionFor(entry)
+
+	var requestID string
+	_, err := t.a.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{rule.SecurityGroupRuleId},
+		Tags:      t.a.identity().tagsFor(entry),
+	}, captureRequestID(&requestID))
+	t.a.audit(ctx, groupID, AuditUpdateTags, []string{ruleID + " owner=" + entry.OwnerID + " node=" + entry.NodeName}, nil, requestID, err)
+	if err != nil {
+		return fmt.Errorf("Error tagging rule %s: %w", aws.StringValue(rule.SecurityGroupRuleId), err)
+	}
+
+	_, err = t.a.ec2.ModifySecurityGroupRulesWithContext(ctx, &ec2.ModifySecurityGroupRulesInput{
+		GroupId: aws.String(groupID),
+		SecurityGroupRules: []*ec2.SecurityGroupRuleUpdate{
+			&ec2.SecurityGroupRuleUpdate{
+				SecurityGroupRuleId: rule.SecurityGroupRuleId,
+				SecurityGroupRule: &ec2.SecurityGroupRuleRequest{
+					CidrIpv4:    rule.CidrIpv4,
+					CidrIpv6:    rule.CidrIpv6,
+					Description: aws.String(description),
+					FromPort:    rule.FromPort,
+					IpProtocol:  rule.IpProtocol,
+					ToPort:      rule.ToPort,
+				},
+			},
+		},
+	}, captureRequestID(&requestID))
+	t.a.audit(ctx, groupID, AuditUpdateDescription, []string{ruleID + " " + description}, nil, requestID, err)
+	if err != nil {
+		return fmt.Errorf("Error updating rule %s: %w", aws.StringValue(rule.SecurityGroupRuleId), err)
+	}
+
+	return nil
+}
+
+// Identifies the rule a security group rule stands for, in the same form as
+// RuleEntry.key and permissionKey.
+func securityGroupRuleKey(rule *ec2.SecurityGroupRule) string {
+	source := aws.StringValue(rule.CidrIpv4)
+	switch {
+	case rule.CidrIpv6 != nil:
+		source = aws.StringValue(rule.CidrIpv6)
+	case rule.PrefixListId != nil:
+		source = aws.StringValue(rule.PrefixListId)
+	case rule.ReferencedGroupInfo != nil:
+		source = aws.StringValue(rule.ReferencedGroupInfo.GroupId)
+		if rule.ReferencedGroupInfo.UserId != nil {
+			source = aws.StringValue(rule.ReferencedGroupInfo.UserId) + "/" + source
+		}
+	}
+
+	return fmt.Sprintf("%s/%d-%d/%s", aws.StringValue(rule.IpProtocol), aws.Int64Value(rule.FromPort),
+		aws.Int64Value(rule.ToPort), source)
+}
@@ -0,0 +1,125 @@
+package awsclient
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestTagGroupState(t *testing.T) {
+	taggedRule := func(id string, cidr string, tags map[string]string) *ec2.SecurityGroupRule {
+		rule := &ec2.SecurityGroupRule{
+			SecurityGroupRuleId: aws.String(id),
+			CidrIpv4:            aws.String(cidr),
+			IpProtocol:          aws.String("tcp"),
+			FromPort:            aws.Int64(5432),
+			ToPort:              aws.Int64(5432),
+			// descriptions are only used for rules without an owner tag
+			Description: aws.String("sgm/v2 owner=owner node=from-description"),
+		}
+		for key, value := range tags {
+			rule.Tags = append(rule.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+		return rule
+	}
+
+	rules := []*ec2.SecurityGroupRule{
+		taggedRule("sgr-1", "10.0.0.1/32", map[string]string{OwnerTagKey: "owner", NodeTagKey: "node1"}),
+		taggedRule("sgr-2", "10.0.0.2/32", map[string]string{OwnerTagKey: "someone-else", NodeTagKey: "node2"}),
+		taggedRule("sgr-3", "10.0.0.3/32", nil),
+		taggedRule("sgr-5", "10.0.0.5/32", map[string]string{NodeTagKey: "node5"}),
+		&ec2.SecurityGroupRule{
+			SecurityGroupRuleId: aws.String("sgr-4"),
+			IpProtocol:          aws.String("-1"),
+			PrefixListId:        aws.String("pl-1234"),
+			Tags:                []*ec2.Tag{&ec2.Tag{Key: aws.String(OwnerTagKey), Value: aws.String("owner")}},
+		},
+	}
+
+	// rules without an owner tag are foreign unless migrating
+	state := tagGroupState("sg-1", rules, &ownerIdentity{ID: "owner"})
+	if state.ForeignRules != 4 || len(state.Owned) != 1 || state.Owned[0].IP != "10.0.0.1/32" {
+		t.Errorf("Expected only 10.0.0.1/32 to be owned, got %v and %d foreign rules", state.Owned, state.ForeignRules)
+	}
+
+	migrating := &ownerIdentity{ID: "owner", TagsMigrationUntil: time.Now().Add(time.Hour)}
+	state = tagGroupState("sg-1", rules, migrating)
+	if state.ForeignRules != 2 {
+		t.Errorf("Expected 2 foreign rules, got %d", state.ForeignRules)
+	}
+
+	expected := []RuleEntry{
+		RuleEntry{NodeName: "node1", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"},
+		RuleEntry{NodeName: "from-description", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.3/32", Protocol: "tcp"},
+		RuleEntry{NodeName: "from-description", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.5/32", Protocol: "tcp"},
+	}
+	if len(state.Owned) != len(expected) {
+		t.Fatalf("Expected %d owned entries, got %v", len(expected), state.Owned)
+	}
+	for idx := range expected {
+		if *state.Owned[idx] != expected[idx] {
+			t.Errorf("Expected %s to be owned, got %s", expected[idx], state.Owned[idx])
+		}
+	}
+
+	// untagged rules written before switching to the tags mode still need
+	// a valid signature
+	signed := &ownerIdentity{ID: "owner", Signing: SigningConfig{Key: []byte("secret")},
+		TagsMigrationUntil: migrating.TagsMigrationUntil}
+	state = tagGroupState("sg-1", rules, signed)
+	for _, entry := range state.Owned {
+		if entry.IP == "10.0.0.3/32" {
+			t.Errorf("Expected an unsigned description not to be owned when signing is enabled")
+		}
+	}
+
+	// and the migration ends on its own
+	expired := &ownerIdentity{ID: "owner", TagsMigrationUntil: time.Now().Add(-time.Hour)}
+	if state = tagGroupState("sg-1", rules, expired); len(state.Owned) != 1 {
+		t.Errorf("Expected untagged rules to be foreign after the migration, got %v", state.Owned)
+	}
+}
+
+func TestTagsMigrationFromEnv(t *testing.T) {
+	defer os.Unsetenv("AWS_SGMANAGER_TAGS_MIGRATION_UNTIL")
+
+	if until, err := TagsMigrationFromEnv(); err != nil || !until.IsZero() {
+		t.Errorf("Expected no migration by default, got %s, %v", until, err)
+	}
+
+	os.Setenv("AWS_SGMANAGER_TAGS_MIGRATION_UNTIL", "2026-11-01T00:00:00Z")
+	until, err := TagsMigrationFromEnv()
+	if err != nil || !until.Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected migration end %s, %v", until, err)
+	}
+
+	os.Setenv("AWS_SGMANAGER_TAGS_MIGRATION_UNTIL", "next week")
+	if _, err = TagsMigrationFromEnv(); err == nil {
+		t.Errorf("Expected an invalid time to be refused")
+	}
+}
+
+func TestOwnershipModeFromEnv(t *testing.T) {
+	defer os.Setenv("AWS_SGMANAGER_OWNERSHIP", os.Getenv("AWS_SGMANAGER_OWNERSHIP"))
+
+	values := map[string]string{
+		"":            OwnershipDescription,
+		"description": OwnershipDescription,
+		"tags":        OwnershipTags,
+	}
+	for value, expected := range values {
+		os.Setenv("AWS_SGMANAGER_OWNERSHIP", value)
+		mode, err := OwnershipModeFromEnv()
+		if err != nil || mode != expected {
+			t.Errorf("Expected '%s' to give %s, got %s (%v)", value, expected, mode, err)
+		}
+	}
+
+	os.Setenv("AWS_SGMANAGER_OWNERSHIP", "invalid")
+	if _, err := OwnershipModeFromEnv(); err == nil {
+		t.Errorf("Expected an error for an invalid mode but got none")
+	}
+}
@@ -0,0 +1,396 @@
+package awsclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Version of the plan file format.
+const planVersion = 1
+
+// A saved set of changes for every target, to be reviewed and then applied as
+// it is.
+type Plan struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"createdAt"`
+	OwnerID   string       `json:"ownerId"`
+	Changes   []*ChangeSet `json:"changes"`
+}
+
+// The changes planned for a single target, along with a fingerprint of the
+// state they were planned against.
+type ChangeSet struct {
+	Target      Target          `json:"target"`
+	Fingerprint string          `json:"fingerprint"`
+	Groups      []*GroupChanges `json:"groups"`
+}
+
+// The entries to add to and remove from one security group or prefix list.
+// New entries are always added before old ones are removed.
+type GroupChanges struct {
+	GroupID   string       `json:"groupId"`
+	Authorize []*RuleEntry `json:"authorize,omitempty"`
+	Revoke    []*RuleEntry `json:"revoke,omitempty"`
+}
+
+// Check whether the change set doesn't change anything.
+func (c *ChangeSet) Empty() bool {
+	for _, group := range c.Groups {
+		if len(group.Authorize) > 0 || len(group.Revoke) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returned when applying a change set to a target that was changed since the
+// change set was planned. Nothing has been changed when this is returned.
+type StalePlanError struct {
+	Target   Target
+	Planned  string
+	Observed string
+}
+
+func (e *StalePlanError) Error() string {
+	return fmt.Sprintf("%s changed since the plan was made (fingerprint %s, now %s), plan again",
+		e.Target, e.Planned, e.Observed)
+}
+
+// Write a plan to a file as JSON.
+func WritePlan(path string, plan *Plan) error {
+	plan.Version = planVersion
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding plan: %w", err)
+	}
+
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing plan to %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Read a plan written by WritePlan.
+func ReadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading plan from %s: %w", path, err)
+	}
+
+	var plan Plan
+	err = json.Unmarshal(data, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding plan %s: %w", path, err)
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("Plan %s has unsupported version %d", path, plan.Version)
+	}
+
+	return &plan, nil
+}
+
+// What a target looked like when it was read.
+type observedState struct {
+	fingerprint string
+
+	// set for security group targets
+	pool []*poolGroup
+
+	// set for prefix list targets
+	prefixList        *ec2.ManagedPrefixList
+	prefixListEntries []*ec2.PrefixListEntry
+}
+
+// Read the current state of the target.
+func (a *AwsContext) observe(ctx context.Context) (*observedState, error) {
+	var state observedState
+	lines := make([]string, 0)
+
+	if a.Target.PrefixListID != "" {
+		prefixList, err := a.waitForPrefixList(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		entries, err := a.getPrefixListEntries(ctx, aws.Int64Value(prefixList.Version))
+		if err != nil {
+			return nil, err
+		}
+
+		state.prefixList = prefixList
+		state.prefixListEntries = entries
+		lines = append(lines, "prefix-list "+a.Target.PrefixListID)
+		for _, entry := range entries {
+			lines = append(lines, fmt.Sprintf("%s %s", aws.StringValue(entry.Cidr), aws.StringValue(entry.Description)))
+		}
+	} else {
+		pool, err := a.getGroupPool(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		state.pool = pool
+		for _, group := range pool {
+			lines = append(lines, "group "+group.GroupID)
+			lines = append(lines, group.fingerprintLines()...)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	state.fingerprint = hex.EncodeToString(sum[:])
+	return &state, nil
+}
+
+// Describe every rule of the group in a stable order, including everything
+// that ownership depends on.
+func (s *groupState) fingerprintLines() []string {
+	lines := make([]string, 0)
+	if s.rules != nil {
+		for _, rule := range s.rules {
+			tags := make([]string, 0)
+			for _, tag := range rule.Tags {
+				tags = append(tags, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+			}
+			sort.Strings(tags)
+			lines = append(lines, fmt.Sprintf("%s %s %s %s", aws.StringValue(rule.SecurityGroupRuleId),
+				securityGroupRuleKey(rule), strings.Join(tags, ","), aws.StringValue(rule.Description)))
+		}
+	} else {
+		for _, rule := range expandRules(s.permissions) {
+			lines = append(lines, fmt.Sprintf("%s %s", permissionKey(rule), ruleDescription(rule)))
+		}
+	}
+
+	sort.Strings(lines)
+	return lines
+}
+
+// Get the keys of the rules in the group that are owned, or not owned, by
+// owner.
+func (s *groupState) ruleKeys(owner *ownerIdentity, owned bool) map[string]bool {
+	keys := make(map[string]bool)
+	if s.rules != nil {
+		for _, rule := range s.rules {
+			if (owner.classifyTaggedRule(rule) == ruleOwned) == owned {
+				keys[securityGroupRuleKey(rule)] = true
+			}
+		}
+	} else {
+		for _, rule := range filterInboundRules(s.permissions, owner, owned) {
+			keys[permissionKey(rule)] = true
+		}
+	}
+
+	return keys
+}
+
+// Work out the changes ReplaceOwnedEntries would make for entries, without
+// making them. Only changes to which addresses are let through are planned,
+// outdated node names in owned rules are left for the next reconcile.
+func (a *AwsContext) PlanChanges(ctx context.Context, entries []*RuleEntry) (*ChangeSet, error) {
+	state, err := a.observe(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("PlanChanges error: %w", err)
+	}
+
+	changes := ChangeSet{Target: a.Target, Fingerprint: state.fingerprint, Groups: make([]*GroupChanges, 0)}
+	if state.prefixList != nil {
+		diff := diffPrefixListEntries(state.prefixListEntries, entries, a.identity())
+		if !diff.empty() {
+			err = a.checkSafety(diff.Owned, diff.Wanted)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		added := make(map[string]bool)
+		for _, add := range diff.Add {
+			added[aws.StringValue(add.Cidr)] = true
+		}
+
+		group := GroupChanges{GroupID: a.Target.PrefixListID}
+		for _, entry := range entries {
+			if added[entry.IP] {
+				group.Authorize = append(group.Authorize, entry)
+				delete(added, entry.IP)
+			}
+		}
+		for _, remove := range diff.Remove {
+			group.Revoke = append(group.Revoke, prefixListRuleEntry(state.prefixListEntries, aws.StringValue(remove.Cidr)))
+		}
+		changes.Groups = append(changes.Groups, &group)
+
+		return &changes, nil
+	}
+
+	owned := 0
+	for _, group := range state.pool {
+		owned += len(group.Owned)
+	}
+	err = a.checkSafety(owned, countDistinctEntries(entries))
+	if err != nil {
+		return nil, err
+	}
+
+	unassigned := assignEntries(state.pool, entries)
+	if len(unassigned) > 0 {
+		return nil, fmt.Errorf("PlanChanges error: %d entries didn't fit in the rule quota of %s and its overflow groups",
+			len(unassigned), a.SecurityGroupID)
+	}
+
+	for _, poolGroup := range state.pool {
+		changes.Groups = append(changes.Groups, diffGroupEntries(poolGroup, a.identity()))
+	}
+
+	return &changes, nil
+}
+
+// Work out which of the entries assigned to a group need to be added and
+// which owned entries need to be removed.
+func diffGroupEntries(group *poolGroup, owner *ownerIdentity) *GroupChanges {
+	changes := GroupChanges{GroupID: group.GroupID}
+	ownedKeys := group.ruleKeys(owner, true)
+	foreignKeys := group.ruleKeys(owner, false)
+
+	wanted := make(map[string]bool)
+	for _, entry := range group.Assigned {
+		key := entry.key()
+		if wanted[key] {
+			continue
+		}
+		wanted[key] = true
+
+		if !ownedKeys[key] && !foreignKeys[key] {
+			changes.Authorize = append(changes.Authorize, entry)
+		}
+	}
+
+	for _, entry := range group.Owned {
+		if !wanted[entry.key()] {
+			changes.Revoke = append(changes.Revoke, entry)
+		}
+	}
+
+	return &changes
+}
+
+// Build the RuleEntry for a prefix list entry, for display in a plan.
+func prefixListRuleEntry(entries []*ec2.PrefixListEntry, cidr string) *RuleEntry {
+	result := RuleEntry{IP: cidr}
+	for _, entry := range entries {
+		if aws.StringValue(entry.Cidr) != cidr {
+			continue
+		}
+		if parsed := RuleEntryFromDescription(entry.Description); parsed != nil {
+			result.OwnerID = parsed.OwnerID
+			result.NodeName = parsed.NodeName
+		}
+	}
+
+	return &result
+}
+
+// Check that the target still looks exactly like it did when the change set
+// was planned, without changing anything. A StalePlanError is returned
+// otherwise. Checking every target of a plan first keeps a stale target from
+// stopping an apply halfway.
+func (a *AwsContext) CheckChanges(ctx context.Context, changes *ChangeSet) error {
+	_, err := a.observeUnchanged(ctx, "CheckChanges", changes)
+	return err
+}
+
+func (a *AwsContext) observeUnchanged(ctx context.Context, operation string, changes *ChangeSet) (*observedState, error) {
+	state, err := a.observe(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s error: %w", operation, err)
+	}
+
+	if state.fingerprint != changes.Fingerprint {
+		return nil, &StalePlanError{Target: a.Target, Planned: changes.Fingerprint, Observed: state.fingerprint}
+	}
+
+	return state, nil
+}
+
+// Apply a change set made by PlanChanges, but only if the target still looks
+// exactly like it did when the change set was planned. A StalePlanError is
+// returned otherwise.
+func (a *AwsContext) ApplyChanges(ctx context.Context, changes *ChangeSet) error {
+	ctx, flushAudit := a.bufferAudit(ctx)
+	defer flushAudit()
+
+	err := a.claimOwnerID(ctx)
+	if err != nil {
+		return err
+	}
+
+	state, err := a.observeUnchanged(ctx, "ApplyChanges", changes)
+	if err != nil {
+		return err
+	}
+
+	if state.prefixList != nil {
+		owner := a.identity()
+		var diff prefixListChanges
+		for _, group := range changes.Groups {
+			for _, entry := range group.Revoke {
+				diff.Remove = append(diff.Remove, &ec2.RemovePrefixListEntry{Cidr: aws.String(entry.IP)})
+			}
+			for _, entry := range group.Authorize {
+				diff.Add = append(diff.Add, &ec2.AddPrefixListEntry{
+					Cidr:        aws.String(entry.IP),
+					Description: aws.String(owner.descriptionFor(signedPrefixListEntry(entry))),
+				})
+			}
+		}
+
+		err = a.snapshotPrefixList(ctx, state.prefixListEntries, false)
+		if err != nil {
+			return fmt.Errorf("ApplyChanges error while saving a snapshot: %w", err)
+		}
+
+		return a.applyPrefixListChanges(ctx, state.prefixList, len(state.prefixListEntries), &diff)
+	}
+
+	err = a.snapshotPool(ctx, state.pool, false)
+	if err != nil {
+		return fmt.Errorf("ApplyChanges error while saving a snapshot: %w", err)
+	}
+
+	groups := make(map[string]*poolGroup)
+	for _, group := range state.pool {
+		groups[group.GroupID] = group
+	}
+
+	for _, group := range changes.Groups {
+		poolGroup, ok := groups[group.GroupID]
+		if !ok {
+			return fmt.Errorf("ApplyChanges error: %s is not part of %s", group.GroupID, a.Target)
+		}
+
+		err = a.ownership().authorizeEntries(ctx, poolGroup.groupState, group.Authorize)
+		if err != nil {
+			return fmt.Errorf("ApplyChanges error in %s: %w", group.GroupID, err)
+		}
+
+		err = a.ownership().revokeEntries(ctx, poolGroup.groupState, group.Revoke)
+		if err != nil {
+			return fmt.Errorf("ApplyChanges error in %s: %w", group.GroupID, err)
+		}
+	}
+
+	return nil
+}
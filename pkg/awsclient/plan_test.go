@@ -0,0 +1,105 @@
+package awsclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestDiffGroupEntries(t *testing.T) {
+	ownerID := "owner"
+
+	foreign := ownedRule("someone-else", "node9", "10.0.0.9/32")
+	group := newPoolGroup("sg-1", 10, []*ec2.IpPermission{
+		ownedRule(ownerID, "node1", "10.0.0.1/32"),
+		ownedRule(ownerID, "node2", "10.0.0.2/32"),
+		foreign,
+	}, ownerID)
+	group.Assigned = []*RuleEntry{
+		&RuleEntry{NodeName: "node1-renamed", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"},
+		&RuleEntry{NodeName: "node3", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.3/32", Protocol: "tcp"},
+		&RuleEntry{NodeName: "node3", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.3/32", Protocol: "tcp"},
+		&RuleEntry{NodeName: "node9", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.9/32", Protocol: "tcp"},
+	}
+
+	changes := diffGroupEntries(group, &ownerIdentity{ID: ownerID})
+	if len(changes.Authorize) != 1 || changes.Authorize[0].IP != "10.0.0.3/32" {
+		t.Errorf("Expected only 10.0.0.3/32 to be authorized, got %v", changes.Authorize)
+	}
+	if len(changes.Revoke) != 1 || changes.Revoke[0].IP != "10.0.0.2/32" {
+		t.Errorf("Expected only 10.0.0.2/32 to be revoked, got %v", changes.Revoke)
+	}
+}
+
+func TestFingerprintLines(t *testing.T) {
+	first := ownedRule("owner", "node1", "10.0.0.1/32")
+	second := ownedRule("owner", "node2", "10.0.0.2/32")
+
+	forward := &groupState{permissions: []*ec2.IpPermission{first, second}}
+	backward := &groupState{permissions: []*ec2.IpPermission{second, first}}
+	if !equalLines(forward.fingerprintLines(), backward.fingerprintLines()) {
+		t.Errorf("Expected the fingerprint not to depend on rule order")
+	}
+
+	// taking over a rule only changes its description, which has to show
+	edited := ownedRule("owner", "node2", "10.0.0.2/32")
+	edited.IpRanges[0].Description = aws.String("sgm/v2 owner=someone-else node=node2")
+	changed := &groupState{permissions: []*ec2.IpPermission{first, edited}}
+	if equalLines(forward.fingerprintLines(), changed.fingerprintLines()) {
+		t.Errorf("Expected the fingerprint to change along with a description")
+	}
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "plan.json")
+	plan := &Plan{OwnerID: "owner", Changes: []*ChangeSet{
+		&ChangeSet{
+			Target:      Target{SecurityGroupID: "sg-1"},
+			Fingerprint: "abc",
+			Groups: []*GroupChanges{&GroupChanges{
+				GroupID:   "sg-1",
+				Authorize: []*RuleEntry{&RuleEntry{NodeName: "node1", OwnerID: "owner", IP: "10.0.0.1/32", Protocol: "tcp"}},
+			}},
+		},
+	}}
+
+	err = WritePlan(path, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.OwnerID != "owner" || len(read.Changes) != 1 || read.Changes[0].Fingerprint != "abc" ||
+		*read.Changes[0].Groups[0].Authorize[0] != *plan.Changes[0].Groups[0].Authorize[0] {
+		t.Errorf("Plan didn't survive the round trip: %v", read)
+	}
+	if read.Changes[0].Empty() {
+		t.Errorf("Expected the change set not to be empty")
+	}
+}
+
+func equalLines(first []string, second []string) bool {
+	if len(first) != len(second) {
+		return false
+	}
+	for idx := range first {
+		if first[idx] != second[idx] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,344 @@
+package awsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ModifyManagedPrefixList accepts at most this many additions and removals
+// per call.
+const maxPrefixListChangesPerCall = 100
+
+// How many times a modification is retried when the prefix list was changed
+// by someone else between reading and writing it.
+const prefixListAttempts = 3
+
+// How often to check whether a prefix list modification has completed.
+const prefixListPollInterval = 2 * time.Second
+
+// Error codes returned when the version passed to ModifyManagedPrefixList is
+// out of date or another modification is still running.
+var prefixListConflictCodes = map[string]bool{
+	"PrefixListVersionMismatch": true,
+	"IncorrectState":            true,
+}
+
+// The entries to add to and remove from a prefix list to bring it in line
+// with a set of owned entries.
+type prefixListChanges struct {
+	Add    []*ec2.AddPrefixListEntry
+	Remove []*ec2.RemovePrefixListEntry
+
+	// CIDRs of entries that claim to be ours but whose signature doesn't
+	// check out. These are left alone.
+	Spoofed []string
+
+	// Number of entries owned before and after the changes.
+	Owned  int
+	Wanted int
+}
+
+func (c *prefixListChanges) empty() bool {
+	return len(c.Add) == 0 && len(c.Remove) == 0
+}
+
+// Make the entries of the target's managed prefix list that are owned by
+// OwnerID match the entries parameter. Entries owned by anyone else are left
+// alone. Prefix list entries only hold a CIDR, so entries that differ only by
+// protocol or port collapse into one.
+func (a *AwsContext) ReplaceOwnedPrefixListEntries(ctx context.Context, entries []*RuleEntry) error {
+	ctx, flushAudit := a.bufferAudit(ctx)
+	defer flushAudit()
+
+	err := a.claimOwnerID(ctx)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt <= prefixListAttempts; attempt++ {
+		err = a.replaceOwnedPrefixListEntries(ctx, entries)
+		if awsErr, ok := unwrapAwsError(err); ok && prefixListConflictCodes[awsErr.Code()] {
+			fmt.Printf("Prefix list %s changed while updating it, retrying: %s\n", a.Target.PrefixListID, err)
+			continue
+		}
+
+		return err
+	}
+
+	return fmt.Errorf("ReplaceOwnedPrefixListEntries error after %d attempts: %w", prefixListAttempts, err)
+}
+
+func (a *AwsContext) replaceOwnedPrefixListEntries(ctx context.Context, entries []*RuleEntry) error {
+	prefixList, err := a.waitForPrefixList(ctx)
+	if err != nil {
+		return err
+	}
+
+	current, err := a.getPrefixListEntries(ctx, aws.Int64Value(prefixList.Version))
+	if err != nil {
+		return err
+	}
+
+	err = a.snapshotPrefixList(ctx, current, false)
+	if err != nil {
+		return fmt.Errorf("ReplaceOwnedPrefixListEntries error while saving a snapshot: %w", err)
+	}
+
+	if a.Adopt {
+		// an entry can only get a new description by being removed and
+		// added again, which would briefly drop its address, so unmarked
+		// entries are left as they are
+		for _, cidr := range unmarkedPrefixListEntries(current, entries) {
+			fmt.Printf("Not adopting entry %s of prefix list %s, prefix list entries can't be relabeled in place\n",
+				cidr, a.Target.PrefixListID)
+		}
+	}
+
+	changes := diffPrefixListEntries(current, entries, a.identity())
+	for _, cidr := range changes.Spoofed {
+		fmt.Printf("Warning: entry %s of prefix list %s claims to be ours but its signature is invalid, leaving it alone\n",
+			cidr, a.Target.PrefixListID)
+	}
+	if a.deferRemovals(ctx, a.Target.PrefixListID, len(changes.Remove)) {
+		changes.Remove = nil
+	}
+	if changes.empty() {
+		return nil
+	}
+
+	err = a.checkSafety(changes.Owned, changes.Wanted)
+	if err != nil {
+		return err
+	}
+
+	return a.applyPrefixListChanges(ctx, prefixList, len(current), changes)
+}
+
+// Apply changes to a prefix list that currently holds currentCount entries,
+// growing it first if needed and allowed.
+func (a *AwsContext) applyPrefixListChanges(ctx context.Context, prefixList *ec2.ManagedPrefixList, currentCount int, changes *prefixListChanges) error {
+	var err error
+	needed := int64(currentCount + len(changes.Add) - len(changes.Remove))
+	if needed > aws.Int64Value(prefixList.MaxEntries) {
+		if !a.Target.AllowResize {
+			return fmt.Errorf("Prefix list %s needs %d entries but only allows %d", a.Target.PrefixListID,
+				needed, aws.Int64Value(prefixList.MaxEntries))
+		}
+
+		prefixList, err = a.resizePrefixList(ctx, prefixList, needed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.modifyPrefixList(ctx, prefixList, changes)
+}
+
+// Make the changes to the prefix list in as many calls as needed, without
+// checking its size first.
+func (a *AwsContext) modifyPrefixList(ctx context.Context, prefixList *ec2.ManagedPrefixList, changes *prefixListChanges) error {
+	// removals go first so that the list never goes over its maximum size
+	// partway through. An address that is both removed and added again is
+	// therefore missing from the list until its addition goes through.
+	batchSize := minInt(a.batchSize(), maxPrefixListChangesPerCall)
+	version := aws.Int64Value(prefixList.Version)
+	for !changes.empty() {
+		input := &ec2.ModifyManagedPrefixListInput{
+			PrefixListId:   aws.String(a.Target.PrefixListID),
+			CurrentVersion: aws.Int64(version),
+		}
+
+		if len(changes.Remove) > 0 {
+			count := minInt(len(changes.Remove), batchSize)
+			input.RemoveEntries = changes.Remove[:count]
+			changes.Remove = changes.Remove[count:]
+		} else {
+			count := minInt(len(changes.Add), batchSize)
+			input.AddEntries = changes.Add[:count]
+			changes.Add = changes.Add[count:]
+		}
+
+		var requestID string
+		_, err := a.ec2.ModifyManagedPrefixListWithContext(ctx, input, captureRequestID(&requestID))
+		a.audit(ctx, a.Target.PrefixListID, AuditModifyPrefixList, auditPrefixListAdditions(input.AddEntries),
+			auditPrefixListRemovals(input.RemoveEntries), requestID, err)
+		if err != nil {
+			return fmt.Errorf("Error modifying prefix list %s: %w", a.Target.PrefixListID, err)
+		}
+
+		prefixList, err = a.waitForPrefixList(ctx)
+		if err != nil {
+			return err
+		}
+		version = aws.Int64Value(prefixList.Version)
+	}
+
+	return nil
+}
+
+// Prefix list entries have no protocol or ports of their own, since those are
+// set by the rules referencing the list, so their markers are signed over the
+// CIDR alone. Get the form of entry that is signed for them.
+func signedPrefixListEntry(entry *RuleEntry) *RuleEntry {
+	return &RuleEntry{OwnerID: entry.OwnerID, NodeName: entry.NodeName, IP: entry.IP}
+}
+
+// Work out which entries need to be added and removed. An entry whose CIDR is
+// already present, even if owned by someone else, is skipped since the address
+// is let through either way.
+func diffPrefixListEntries(current []*ec2.PrefixListEntry, entries []*RuleEntry, owner *ownerIdentity) *prefixListChanges {
+	var changes prefixListChanges
+
+	currentByCidr := make(map[string]*ec2.PrefixListEntry)
+	for _, entry := range current {
+		currentByCidr[aws.StringValue(entry.Cidr)] = entry
+	}
+
+	wanted := make(map[string]bool)
+	for _, entry := range entries {
+		if wanted[entry.IP] {
+			continue
+		}
+		wanted[entry.IP] = true
+
+		// an existing entry is kept as it is, even if its node name is
+		// out of date, since replacing it would briefly drop the address
+		if _, ok := currentByCidr[entry.IP]; ok {
+			continue
+		}
+
+		changes.Add = append(changes.Add, &ec2.AddPrefixListEntry{
+			Cidr:        aws.String(entry.IP),
+			Description: aws.String(owner.descriptionFor(signedPrefixListEntry(entry))),
+		})
+	}
+
+	for _, entry := range current {
+		switch owner.classifyDescription(entry.Description, &RuleEntry{IP: aws.StringValue(entry.Cidr)}) {
+		case ruleOwned:
+			changes.Owned++
+			if !wanted[aws.StringValue(entry.Cidr)] {
+				changes.Remove = append(changes.Remove, &ec2.RemovePrefixListEntry{Cidr: entry.Cidr})
+			}
+		case ruleSpoofed:
+			changes.Spoofed = append(changes.Spoofed, aws.StringValue(entry.Cidr))
+		}
+	}
+
+	changes.Wanted = len(wanted)
+	return &changes
+}
+
+// Get all the entries of the prefix list at the given version.
+func (a *AwsContext) getPrefixListEntries(ctx context.Context, version int64) ([]*ec2.PrefixListEntry, error) {
+	input := &ec2.GetManagedPrefixListEntriesInput{
+		PrefixListId:  aws.String(a.Target.PrefixListID),
+		TargetVersion: aws.Int64(version),
+	}
+
+	results := make([]*ec2.PrefixListEntry, 0)
+	err := a.ec2.GetManagedPrefixListEntriesPagesWithContext(ctx, input, func(page *ec2.GetManagedPrefixListEntriesOutput, lastPage bool) bool {
+		results = append(results, page.Entries...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting entries of prefix list %s: %w", a.Target.PrefixListID, err)
+	}
+
+	return results, nil
+}
+
+// Describe the prefix list, waiting for any modification that is in progress
+// to finish first.
+func (a *AwsContext) waitForPrefixList(ctx context.Context) (*ec2.ManagedPrefixList, error) {
+	for {
+		output, err := a.ec2.DescribeManagedPrefixListsWithContext(ctx, &ec2.DescribeManagedPrefixListsInput{
+			PrefixListIds: []*string{aws.String(a.Target.PrefixListID)},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error describing prefix list %s: %w", a.Target.PrefixListID, err)
+		}
+		if len(output.PrefixLists) == 0 {
+			return nil, fmt.Errorf("Prefix list %s not found", a.Target.PrefixListID)
+		}
+
+		prefixList := output.PrefixLists[0]
+		switch aws.StringValue(prefixList.State) {
+		case ec2.PrefixListStateCreateInProgress, ec2.PrefixListStateModifyInProgress, ec2.PrefixListStateRestoreInProgress:
+		case ec2.PrefixListStateCreateFailed, ec2.PrefixListStateDeleteInProgress, ec2.PrefixListStateDeleteComplete:
+			return nil, fmt.Errorf("Prefix list %s is in state %s: %s", a.Target.PrefixListID,
+				aws.StringValue(prefixList.State), aws.StringValue(prefixList.StateMessage))
+		default:
+			return prefixList, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(prefixListPollInterval):
+		}
+	}
+}
+
+// Grow the prefix list so that it can hold maxEntries entries. Note that every
+// security group referencing the list counts its maximum size against its
+// own rule quota.
+func (a *AwsContext) resizePrefixList(ctx context.Context, prefixList *ec2.ManagedPrefixList, maxEntries int64) (*ec2.ManagedPrefixList, error) {
+	fmt.Printf("Growing prefix list %s from %d to %d entries\n", a.Target.PrefixListID,
+		aws.Int64Value(prefixList.MaxEntries), maxEntries)
+
+	var requestID string
+	_, err := a.ec2.ModifyManagedPrefixListWithContext(ctx, &ec2.ModifyManagedPrefixListInput{
+		PrefixListId: aws.String(a.Target.PrefixListID),
+		MaxEntries:   aws.Int64(maxEntries),
+	}, captureRequestID(&requestID))
+	a.audit(ctx, a.Target.PrefixListID, AuditResizePrefixList, []string{fmt.Sprintf("max-entries=%d", maxEntries)},
+		nil, requestID, err)
+	if err != nil {
+		return nil, fmt.Errorf("Error resizing prefix list %s: %w", a.Target.PrefixListID, err)
+	}
+
+	return a.waitForPrefixList(ctx)
+}
+
+func auditPrefixListAdditions(entries []*ec2.AddPrefixListEntry) []string {
+	results := make([]string, 0)
+	for _, entry := range entries {
+		results = append(results, fmt.Sprintf("%s %s", aws.StringValue(entry.Cidr), aws.StringValue(entry.Description)))
+	}
+
+	return results
+}
+
+func auditPrefixListRemovals(entries []*ec2.RemovePrefixListEntry) []string {
+	results := make([]string, 0)
+	for _, entry := range entries {
+		results = append(results, aws.StringValue(entry.Cidr))
+	}
+
+	return results
+}
+
+// Find the AWS error in an error chain, if there is one.
+func unwrapAwsError(err error) (awserr.Error, bool) {
+	var awsErr awserr.Error
+	if err != nil && errors.As(err, &awsErr) {
+		return awsErr, true
+	}
+
+	return nil, false
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
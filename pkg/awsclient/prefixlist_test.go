@@ -0,0 +1,39 @@
+package awsclient
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestDiffPrefixListEntries(t *testing.T) {
+	ownerID := "owner"
+	prefixListEntry := func(cidr string, description string) *ec2.PrefixListEntry {
+		return &ec2.PrefixListEntry{Cidr: aws.String(cidr), Description: aws.String(description)}
+	}
+
+	current := []*ec2.PrefixListEntry{
+		prefixListEntry("10.0.0.1/32", "ownerid=owner ; nodename=node1"),
+		prefixListEntry("10.0.0.2/32", "ownerid=owner ; nodename=gone"),
+		prefixListEntry("10.0.0.3/32", "ownerid=someone-else ; nodename=other"),
+		prefixListEntry("10.0.0.4/32", "added by hand"),
+		&ec2.PrefixListEntry{Cidr: aws.String("10.0.0.5/32")},
+	}
+
+	entries := []*RuleEntry{
+		&RuleEntry{NodeName: "node1", OwnerID: ownerID, FromPort: 1, ToPort: 1, IP: "10.0.0.1/32", Protocol: "tcp"},
+		&RuleEntry{NodeName: "node1", OwnerID: ownerID, FromPort: 2, ToPort: 2, IP: "10.0.0.1/32", Protocol: "tcp"},
+		&RuleEntry{NodeName: "node3", OwnerID: ownerID, FromPort: 1, ToPort: 1, IP: "10.0.0.3/32", Protocol: "tcp"},
+		&RuleEntry{NodeName: "node6", OwnerID: ownerID, FromPort: 1, ToPort: 1, IP: "10.0.0.6/32", Protocol: "tcp"},
+	}
+
+	changes := diffPrefixListEntries(current, entries, &ownerIdentity{ID: ownerID})
+
+	if len(changes.Add) != 1 || aws.StringValue(changes.Add[0].Cidr) != "10.0.0.6/32" {
+		t.Errorf("Expected only 10.0.0.6/32 to be added, got %v", changes.Add)
+	}
+	if len(changes.Remove) != 1 || aws.StringValue(changes.Remove[0].Cidr) != "10.0.0.2/32" {
+		t.Errorf("Expected only 10.0.0.2/32 to be removed, got %v", changes.Remove)
+	}
+}
@@ -0,0 +1,267 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+)
+
+// Service Quotas codes for "Inbound or outbound rules per security group".
+const (
+	ruleQuotaServiceCode = "vpc"
+	ruleQuotaCode        = "L-0EA8095F"
+)
+
+// The AWS default for inbound rules per security group, used when the quota
+// can't be looked up.
+const defaultRuleQuota = 60
+
+// Percentage of the rule quota at which a warning gets logged.
+const defaultQuotaWarnPercent = 80
+
+// Security groups tagged with this key, with the ID of a managed security
+// group as the value, form the overflow pool of that security group.
+const OverflowTagKey = "aws-securitygroup-manager/overflow-for"
+
+// Settings for keeping security groups within their rule quota.
+type QuotaConfig struct {
+	// Maximum number of inbound rules per security group. Zero means that
+	// the value is looked up through the Service Quotas API.
+	RuleQuota int
+
+	// Log a warning once a group uses this percentage of its quota.
+	WarnPercent int
+
+	// Spill entries that don't fit into overflow security groups that are
+	// tagged with OverflowTagKey.
+	Overflow bool
+}
+
+// Load the QuotaConfig from the environment.
+func QuotaConfigFromEnv() (QuotaConfig, error) {
+	config := QuotaConfig{WarnPercent: defaultQuotaWarnPercent}
+	var err error
+
+	if value := os.Getenv("AWS_SGMANAGER_RULE_QUOTA"); value != "" {
+		config.RuleQuota, err = strconv.Atoi(value)
+		if err != nil || config.RuleQuota <= 0 {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_RULE_QUOTA value: %s", value)
+		}
+	}
+
+	if value := os.Getenv("AWS_SGMANAGER_QUOTA_WARN_PERCENT"); value != "" {
+		config.WarnPercent, err = strconv.Atoi(value)
+		if err != nil || config.WarnPercent <= 0 || config.WarnPercent > 100 {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_QUOTA_WARN_PERCENT value: %s", value)
+		}
+	}
+
+	if value := os.Getenv("AWS_SGMANAGER_OVERFLOW"); value != "" {
+		config.Overflow, err = strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_OVERFLOW value: %s", value)
+		}
+	}
+
+	return config, nil
+}
+
+// A security group that owned entries can be placed in, along with its
+// current state and the entries that have been assigned to it.
+type poolGroup struct {
+	*groupState
+	Quota    int
+	Assigned []*RuleEntry
+}
+
+// Number of rules the group will have once its assigned entries are in place.
+func (g *poolGroup) usage() int {
+	return g.ForeignRules + len(g.Assigned)
+}
+
+// Count the rules in a list of ec2.IpPermission objects the way the quota
+// does, which is once per source rather than once per IpPermission.
+func countRules(rules []*ec2.IpPermission) int {
+	count := 0
+	for _, rule := range rules {
+		count += len(rule.IpRanges) + len(rule.Ipv6Ranges) + len(rule.PrefixListIds) + len(rule.UserIdGroupPairs)
+	}
+
+	return count
+}
+
+// Get the managed security group followed by its overflow groups, if enabled,
+// along with their current rules.
+func (a *AwsContext) getGroupPool(ctx context.Context) ([]*poolGroup, error) {
+	quota := a.ruleQuota(ctx)
+
+	groupIDs, err := a.getPoolGroupIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := make([]*poolGroup, 0)
+	for _, groupID := range groupIDs {
+		state, err := a.ownership().getGroupState(ctx, groupID)
+		if err != nil {
+			return nil, err
+		}
+
+		pool = append(pool, &poolGroup{groupState: state, Quota: quota})
+	}
+
+	return pool, nil
+}
+
+// Get the managed security group followed by its overflow groups, if enabled.
+func (a *AwsContext) getPoolGroupIDs(ctx context.Context) ([]string, error) {
+	groupIDs := []string{a.SecurityGroupID}
+	if a.Quota.Overflow {
+		overflowIDs, err := a.getOverflowGroupIDs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		groupIDs = append(groupIDs, overflowIDs...)
+	}
+
+	return groupIDs, nil
+}
+
+// Find the overflow groups of the managed security group. They're sorted by ID
+// so that new entries are always placed in the same order.
+func (a *AwsContext) getOverflowGroupIDs(ctx context.Context) ([]string, error) {
+	input := &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag:" + OverflowTagKey),
+				Values: []*string{aws.String(a.SecurityGroupID)},
+			},
+		},
+	}
+
+	results := make([]string, 0)
+	err := a.ec2.DescribeSecurityGroupsPagesWithContext(ctx, input, func(page *ec2.DescribeSecurityGroupsOutput, lastPage bool) bool {
+		for _, group := range page.SecurityGroups {
+			if aws.StringValue(group.GroupId) != a.SecurityGroupID {
+				results = append(results, aws.StringValue(group.GroupId))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error finding overflow groups of %s: %w", a.SecurityGroupID, err)
+	}
+
+	sort.Strings(results)
+	return results, nil
+}
+
+// Get the inbound rule quota per security group. A configured value wins,
+// otherwise it is looked up through the Service Quotas API until that
+// succeeds. Until then the AWS default is assumed. Lookups that can't ever
+// succeed, such as without permission, pin the default.
+func (a *AwsContext) ruleQuota(ctx context.Context) int {
+	if a.Quota.RuleQuota > 0 {
+		return a.Quota.RuleQuota
+	}
+
+	a.quotaMutex.Lock()
+	defer a.quotaMutex.Unlock()
+	if a.lookedUpQuota > 0 {
+		return a.lookedUpQuota
+	}
+
+	output, err := servicequotas.New(a.session).GetServiceQuotaWithContext(ctx, &servicequotas.GetServiceQuotaInput{
+		ServiceCode: aws.String(ruleQuotaServiceCode),
+		QuotaCode:   aws.String(ruleQuotaCode),
+	})
+	if err != nil {
+		fmt.Printf("Couldn't look up the security group rule quota for %s, assuming %d: %s\n",
+			a.Target, defaultRuleQuota, err)
+		if isAwsErrorCode(err, servicequotas.ErrCodeAccessDeniedException) ||
+			isAwsErrorCode(err, servicequotas.ErrCodeNoSuchResourceException) {
+			a.lookedUpQuota = defaultRuleQuota
+		}
+		return defaultRuleQuota
+	}
+
+	a.lookedUpQuota = int(aws.Float64Value(output.Quota.Value))
+	return a.lookedUpQuota
+}
+
+// Log a warning for every group in the pool whose usage is getting close to
+// its quota.
+func (a *AwsContext) warnOnQuotaUsage(pool []*poolGroup) {
+	warnPercent := a.Quota.WarnPercent
+	if warnPercent == 0 {
+		warnPercent = defaultQuotaWarnPercent
+	}
+
+	for _, group := range pool {
+		usage := group.usage()
+		if usage*100 >= group.Quota*warnPercent {
+			fmt.Printf("Warning: security group %s will use %d of %d allowed inbound rules\n",
+				group.GroupID, usage, group.Quota)
+		}
+	}
+}
+
+// Spread entries over the groups in the pool. An entry that already lives in a
+// group stays there so that the mapping is stable across reconciles. New
+// entries go into the first group with room to spare. Entries that don't fit
+// anywhere are returned. Entries with the same key as an earlier one are
+// dropped, as they would end up as the same rule and must only be counted
+// once.
+func assignEntries(pool []*poolGroup, entries []*RuleEntry) []*RuleEntry {
+	// find out where each currently owned entry lives
+	currentGroup := make(map[string]*poolGroup)
+	for _, group := range pool {
+		for _, entry := range group.Owned {
+			currentGroup[entry.key()] = group
+		}
+	}
+
+	hasRoom := func(group *poolGroup) bool {
+		return group.usage() < group.Quota
+	}
+
+	seen := make(map[string]bool)
+	pending := make([]*RuleEntry, 0)
+	for _, entry := range entries {
+		if seen[entry.key()] {
+			continue
+		}
+		seen[entry.key()] = true
+
+		group, ok := currentGroup[entry.key()]
+		if ok && hasRoom(group) {
+			group.Assigned = append(group.Assigned, entry)
+		} else {
+			pending = append(pending, entry)
+		}
+	}
+
+	unassigned := make([]*RuleEntry, 0)
+	for _, entry := range pending {
+		placed := false
+		for _, group := range pool {
+			if hasRoom(group) {
+				group.Assigned = append(group.Assigned, entry)
+				placed = true
+				break
+			}
+		}
+
+		if !placed {
+			unassigned = append(unassigned, entry)
+		}
+	}
+
+	return unassigned
+}
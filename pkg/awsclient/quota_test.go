@@ -0,0 +1,125 @@
+package awsclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func ownedRule(ownerID string, nodeName string, ip string) *ec2.IpPermission {
+	entry := RuleEntry{NodeName: nodeName, OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: ip, Protocol: "tcp"}
+	return RuleEntriesToAwsIpPermissions([]*RuleEntry{&entry})[0]
+}
+
+func newPoolGroup(groupID string, quota int, rules []*ec2.IpPermission, ownerID string) *poolGroup {
+	return &poolGroup{groupState: descriptionGroupState(groupID, rules, &ownerIdentity{ID: ownerID}), Quota: quota}
+}
+
+func TestAssignEntries(t *testing.T) {
+	ownerID := "owner"
+
+	t.Run("Existing entries stay where they are", func(t *testing.T) {
+		primary := newPoolGroup("sg-1", 2, []*ec2.IpPermission{
+			ownedRule(ownerID, "node1", "10.0.0.1/32"),
+		}, ownerID)
+		overflow := newPoolGroup("sg-2", 2, []*ec2.IpPermission{
+			ownedRule(ownerID, "node2", "10.0.0.2/32"),
+		}, ownerID)
+
+		entries := []*RuleEntry{
+			&RuleEntry{NodeName: "node2", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.2/32", Protocol: "tcp"},
+			&RuleEntry{NodeName: "node1", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"},
+			&RuleEntry{NodeName: "node3", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.3/32", Protocol: "tcp"},
+		}
+
+		unassigned := assignEntries([]*poolGroup{primary, overflow}, entries)
+		if len(unassigned) != 0 {
+			t.Fatalf("Expected every entry to fit, %d didn't", len(unassigned))
+		}
+		if len(primary.Assigned) != 2 || primary.Assigned[0].NodeName != "node1" || primary.Assigned[1].NodeName != "node3" {
+			t.Errorf("Unexpected entries assigned to the primary group: %v", primary.Assigned)
+		}
+		if len(overflow.Assigned) != 1 || overflow.Assigned[0].NodeName != "node2" {
+			t.Errorf("Unexpected entries assigned to the overflow group: %v", overflow.Assigned)
+		}
+	})
+
+	t.Run("Foreign rules use up quota", func(t *testing.T) {
+		primary := newPoolGroup("sg-1", 2, []*ec2.IpPermission{
+			ownedRule("someone-else", "other", "10.1.0.1/32"),
+		}, ownerID)
+
+		entries := []*RuleEntry{
+			&RuleEntry{NodeName: "node1", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"},
+			&RuleEntry{NodeName: "node2", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.2/32", Protocol: "tcp"},
+		}
+
+		unassigned := assignEntries([]*poolGroup{primary}, entries)
+		if len(primary.Assigned) != 1 {
+			t.Errorf("Expected 1 entry in the primary group, got %d", len(primary.Assigned))
+		}
+		if len(unassigned) != 1 || unassigned[0].NodeName != "node2" {
+			t.Errorf("Expected node2 to be left over, got %v", unassigned)
+		}
+	})
+
+	t.Run("Duplicate entries are counted once", func(t *testing.T) {
+		primary := newPoolGroup("sg-1", 2, []*ec2.IpPermission{}, ownerID)
+
+		entries := []*RuleEntry{
+			&RuleEntry{NodeName: "node1", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"},
+			&RuleEntry{NodeName: "node1", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"},
+			&RuleEntry{NodeName: "node2", OwnerID: ownerID, FromPort: 5432, ToPort: 5432, IP: "10.0.0.2/32", Protocol: "tcp"},
+		}
+
+		unassigned := assignEntries([]*poolGroup{primary}, entries)
+		if len(primary.Assigned) != 2 || len(unassigned) != 0 {
+			t.Errorf("Expected both distinct entries in the primary group, got %v and %v left over",
+				primary.Assigned, unassigned)
+		}
+	})
+}
+
+func TestRuleQuotaLookup(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+
+	calls := 0
+	failure := awserr.New(request.CanceledErrorCode, "request context canceled", context.DeadlineExceeded)
+	sess.Handlers.Send.Clear()
+	sess.Handlers.Send.PushBack(func(r *request.Request) {
+		calls++
+		if calls == 1 {
+			r.Error = failure
+			return
+		}
+		r.HTTPResponse = &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"Quota": {"Value": 200}}`)),
+		}
+	})
+
+	a := AwsContext{session: sess}
+	if quota := a.ruleQuota(context.Background()); quota != defaultRuleQuota {
+		t.Errorf("Expected the default quota while the lookup fails, got %d", quota)
+	}
+	if quota := a.ruleQuota(context.Background()); quota != 200 {
+		t.Errorf("Expected the failed lookup to be retried, got %d", quota)
+	}
+	if quota := a.ruleQuota(context.Background()); quota != 200 || calls != 2 {
+		t.Errorf("Expected a successful lookup to be remembered, got %d after %d calls", quota, calls)
+	}
+}
@@ -0,0 +1,126 @@
+package awsclient
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/metrics"
+	"golang.org/x/time/rate"
+)
+
+// Defaults for the client side limit on AWS API calls. Many clusters may
+// share the EC2 API budget of an account, so the manager stays well below it.
+const (
+	defaultAPIRate       = 5.0
+	defaultAPIBurst      = 10
+	defaultAPIMaxRetries = 8
+)
+
+// How long the SDK waits before retrying a throttled call. The delay grows
+// exponentially between these with every attempt.
+const (
+	minThrottleDelay = 1 * time.Second
+	maxThrottleDelay = 30 * time.Second
+)
+
+// Limits on the AWS API calls made by every target together.
+type RateLimitConfig struct {
+	// Calls per second allowed on average. 0 disables the limit.
+	RequestsPerSecond float64
+
+	// Calls allowed at once after a quiet period.
+	Burst int
+
+	// How often a call that failed with a retryable error, such as
+	// RequestLimitExceeded, is retried before giving up.
+	MaxRetries int
+}
+
+// Load the RateLimitConfig from the environment.
+func RateLimitConfigFromEnv() (RateLimitConfig, error) {
+	config := RateLimitConfig{
+		RequestsPerSecond: defaultAPIRate,
+		Burst:             defaultAPIBurst,
+		MaxRetries:        defaultAPIMaxRetries,
+	}
+
+	if value := os.Getenv("AWS_SGMANAGER_API_RATE"); value != "" {
+		requestsPerSecond, err := strconv.ParseFloat(value, 64)
+		if err != nil || requestsPerSecond < 0 {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_API_RATE value: %s", value)
+		}
+		config.RequestsPerSecond = requestsPerSecond
+	}
+
+	if value := os.Getenv("AWS_SGMANAGER_API_BURST"); value != "" {
+		burst, err := strconv.Atoi(value)
+		if err != nil || burst < 1 {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_API_BURST value: %s", value)
+		}
+		config.Burst = burst
+	}
+
+	if value := os.Getenv("AWS_SGMANAGER_API_MAX_RETRIES"); value != "" {
+		maxRetries, err := strconv.Atoi(value)
+		if err != nil || maxRetries < 0 {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_API_MAX_RETRIES value: %s", value)
+		}
+		config.MaxRetries = maxRetries
+	}
+
+	return config, nil
+}
+
+// Apply config to every session handed out from now on. All of them share a
+// single token bucket, and every attempt of a call, retries included, takes
+// a token from it. Throttled calls are counted in the metrics.
+func (c *SessionCache) LimitRate(config RateLimitConfig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	request.WithRetryer(c.base.Config, client.DefaultRetryer{
+		NumMaxRetries:    config.MaxRetries,
+		MinRetryDelay:    client.DefaultRetryerMinRetryDelay,
+		MaxRetryDelay:    client.DefaultRetryerMaxRetryDelay,
+		MinThrottleDelay: minThrottleDelay,
+		MaxThrottleDelay: maxThrottleDelay,
+	})
+
+	if config.RequestsPerSecond > 0 {
+		limiter := rate.NewLimiter(rate.Limit(config.RequestsPerSecond), config.Burst)
+		c.base.Handlers.Sign.PushFrontNamed(request.NamedHandler{
+			Name: "sgmanager.RateLimit",
+			Fn:   rateLimitHandler(limiter),
+		})
+	}
+
+	c.base.Handlers.CompleteAttempt.PushBackNamed(request.NamedHandler{
+		Name: "sgmanager.CountThrottles",
+		Fn:   countThrottles,
+	})
+}
+
+// Build a handler that waits for a token before each attempt of a call. The
+// call fails without being sent if its context ends first.
+func rateLimitHandler(limiter *rate.Limiter) func(*request.Request) {
+	return func(r *request.Request) {
+		start := time.Now()
+		err := limiter.Wait(r.Context())
+		metrics.AWSRateLimitWait.Add(time.Since(start).Seconds())
+		if err != nil {
+			r.Error = awserr.New(request.CanceledErrorCode, "Canceled while waiting for the AWS API rate limit", err)
+		}
+	}
+}
+
+func countThrottles(r *request.Request) {
+	if r.Error != nil && request.IsErrorThrottle(r.Error) {
+		fmt.Printf("AWS throttled %s, retry %d of %d\n", r.Operation.Name, r.RetryCount+1, r.MaxRetries())
+		metrics.AWSThrottledRequests.WithLabelValues(r.Operation.Name).Inc()
+	}
+}
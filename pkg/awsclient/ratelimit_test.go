@@ -0,0 +1,55 @@
+package awsclient
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimitConfigFromEnv(t *testing.T) {
+	defer os.Unsetenv("AWS_SGMANAGER_API_RATE")
+	defer os.Unsetenv("AWS_SGMANAGER_API_BURST")
+
+	config, err := RateLimitConfigFromEnv()
+	if err != nil || config.RequestsPerSecond != defaultAPIRate || config.Burst != defaultAPIBurst || config.MaxRetries != defaultAPIMaxRetries {
+		t.Errorf("Unexpected default config %+v, %v", config, err)
+	}
+
+	os.Setenv("AWS_SGMANAGER_API_RATE", "0.5")
+	os.Setenv("AWS_SGMANAGER_API_BURST", "3")
+	config, err = RateLimitConfigFromEnv()
+	if err != nil || config.RequestsPerSecond != 0.5 || config.Burst != 3 {
+		t.Errorf("Unexpected config %+v, %v", config, err)
+	}
+
+	os.Setenv("AWS_SGMANAGER_API_BURST", "0")
+	if _, err = RateLimitConfigFromEnv(); err == nil {
+		t.Errorf("Expected a burst of 0 to be refused")
+	}
+}
+
+func TestRateLimitHandlerCanceled(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Limit(0.001), 1)
+	handler := rateLimitHandler(limiter)
+
+	r := request.Request{HTTPRequest: &http.Request{}}
+	r.SetContext(context.Background())
+	handler(&r)
+	if r.Error != nil {
+		t.Fatalf("Expected the first call to go through, got %s", r.Error)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.SetContext(ctx)
+	handler(&r)
+	awsErr, ok := r.Error.(awserr.Error)
+	if !ok || awsErr.Code() != request.CanceledErrorCode {
+		t.Errorf("Expected the call to be canceled while waiting, got %v", r.Error)
+	}
+}
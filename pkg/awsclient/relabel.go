@@ -0,0 +1,257 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Build the owner ID of a cluster from the UID of its kube-system namespace.
+func ClusterOwnerID(clusterUID string) string {
+	return "k8s-" + clusterUID
+}
+
+// Build the owner ID of an EKS cluster from its account and name.
+func EKSOwnerID(accountID string, clusterName string) string {
+	return fmt.Sprintf("eks-%s-%s", accountID, clusterName)
+}
+
+// Hand every entry owned by fromOwnerID over to the current owner ID. The
+// markers of the existing rules are rewritten in place, so the addresses they
+// let through are never interrupted. Entries whose signature doesn't check out
+// are left alone. Returns the number of entries that were relabeled.
+//
+// Prefix lists are refused, see CheckRelabelable.
+func (a *AwsContext) RelabelOwnedEntries(ctx context.Context, fromOwnerID string) (int, error) {
+	ctx, flushAudit := a.bufferAudit(ctx)
+	defer flushAudit()
+
+	if (&Description{OwnerID: fromOwnerID}).MatchesOwner(a.OwnerID) {
+		return 0, fmt.Errorf("RelabelOwnedEntries error: %s is already the current owner ID", fromOwnerID)
+	}
+
+	err := a.CheckRelabelable()
+	if err != nil {
+		return 0, fmt.Errorf("RelabelOwnedEntries error: %w", err)
+	}
+
+	from := a.identityOf(fromOwnerID)
+	cidrs, err := a.relabelEntries(ctx, from, a.identity(), nil)
+	if err != nil {
+		return len(cidrs), fmt.Errorf("RelabelOwnedEntries error: %w", err)
+	}
+
+	return len(cidrs), nil
+}
+
+// Check whether the markers of the target's entries can be rewritten without
+// interrupting the addresses they let through. Prefix list entries can't be
+// changed in place, only removed and added again, which drops their address
+// until the next version of the list, so prefix lists are refused.
+func (a *AwsContext) CheckRelabelable() error {
+	if a.Target.PrefixListID != "" {
+		return fmt.Errorf("The entries of prefix list %s can't be relabeled without briefly dropping them",
+			a.Target.PrefixListID)
+	}
+
+	return nil
+}
+
+// Hand the entries owned by the current owner ID over to toOwnerID, in place
+// like RelabelOwnedEntries. If cidrs is given, only entries for those CIDRs
+// are handed over. Single addresses count as CIDRs of one address. The new
+// owner has to have sent a heartbeat to the target within the conflict
+// window, which guards against handing rules to a mistyped owner ID that
+// nobody manages. Returns the CIDRs of the entries that were handed over, one
+// per entry.
+//
+// Prefix lists are refused, see CheckRelabelable.
+func (a *AwsContext) TransferOwnedEntries(ctx context.Context, toOwnerID string, cidrs []string) ([]string, error) {
+	ctx, flushAudit := a.bufferAudit(ctx)
+	defer flushAudit()
+
+	selected, err := a.checkTransfer(ctx, toOwnerID, cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("TransferOwnedEntries error: %w", err)
+	}
+
+	to := a.identityOf(toOwnerID)
+	moved, err := a.relabelEntries(ctx, a.identity(), to, selected)
+	if err != nil {
+		return moved, fmt.Errorf("TransferOwnedEntries error: %w", err)
+	}
+
+	return moved, nil
+}
+
+// Get the CIDRs of the entries that TransferOwnedEntries would hand over to
+// toOwnerID for the same cidrs, one per entry, without changing anything. The
+// same checks are made, so an error here means the transfer would fail too.
+func (a *AwsContext) TransferableEntries(ctx context.Context, toOwnerID string, cidrs []string) ([]string, error) {
+	selected, err := a.checkTransfer(ctx, toOwnerID, cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("TransferableEntries error: %w", err)
+	}
+
+	pool, err := a.getGroupPool(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("TransferableEntries error: %w", err)
+	}
+
+	results := make([]string, 0)
+	for _, group := range pool {
+		for _, entry := range group.Owned {
+			if selected == nil || selected[entry.IP] {
+				results = append(results, entry.IP)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// Check that entries can be handed over to toOwnerID and get the set of
+// selected CIDRs, see TransferOwnedEntries.
+func (a *AwsContext) checkTransfer(ctx context.Context, toOwnerID string, cidrs []string) (map[string]bool, error) {
+	if (&Description{OwnerID: toOwnerID}).MatchesOwner(a.OwnerID) {
+		return nil, fmt.Errorf("%s is already the current owner ID", toOwnerID)
+	}
+
+	err := a.CheckRelabelable()
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := selectCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeats, err := a.getHeartbeats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	beat := latestHeartbeat(heartbeatsOf(heartbeats, toOwnerID))
+	if beat == nil || time.Since(beat.Time) > a.conflictWindow() {
+		return nil, fmt.Errorf("%s has no recent heartbeat on %s, is its manager running?",
+			toOwnerID, a.targetResourceID())
+	}
+
+	return selected, nil
+}
+
+// Build the set of normalized cidrs, or nil if none are given, which stands
+// for all of them.
+func selectCIDRs(cidrs []string) (map[string]bool, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+
+	selected := make(map[string]bool)
+	for _, value := range cidrs {
+		cidr, err := NormalizeCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		selected[cidr] = true
+	}
+
+	return selected, nil
+}
+
+// Bring a CIDR, or a single address, into the form AWS uses for rule
+// sources, so that it can be compared to them as a string.
+func NormalizeCIDR(value string) (string, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", fmt.Errorf("Invalid CIDR %s", value)
+	}
+
+	return network.String(), nil
+}
+
+// Rewrite the markers of the entries owned by from to mark them as owned by
+// to. If selected isn't nil, only the entries for the CIDRs in it are
+// relabeled. Returns the CIDRs of the relabeled entries, one per entry.
+//
+// AWS refuses a second rule that only differs from an existing one by its
+// marker, so the rules can't be added again under the new marker before the
+// old ones are removed. Rewriting the markers in place is just as safe, since
+// the rules themselves never change.
+func (a *AwsContext) relabelEntries(ctx context.Context, from *ownerIdentity, to *ownerIdentity, selected map[string]bool) ([]string, error) {
+	err := a.claimOwnerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := a.getGroupPool(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.snapshotPool(ctx, pool, false)
+	if err != nil {
+		return nil, fmt.Errorf("Error saving a snapshot: %w", err)
+	}
+
+	relabeled := make([]string, 0)
+	for _, group := range pool {
+		if group.rules != nil {
+			tags := &tagOwnership{a}
+			for _, rule := range group.rules {
+				if from.classifyTaggedRule(rule) != ruleOwned {
+					continue
+				}
+
+				entry := ruleEntryFromTaggedRule(rule)
+				if selected != nil && !selected[entry.IP] {
+					continue
+				}
+
+				entry.OwnerID = to.ID
+				err = tags.updateMarker(ctx, group.GroupID, rule, entry)
+				if err != nil {
+					return relabeled, err
+				}
+				relabeled = append(relabeled, entry.IP)
+			}
+			continue
+		}
+
+		rules := relabelPermissions(group.permissions, from, to, selected)
+		err = a.updateRuleDescriptions(ctx, group.GroupID, rules)
+		if err != nil {
+			return relabeled, err
+		}
+		for _, rule := range rules {
+			relabeled = append(relabeled, ruleSourceOf(rule).ID)
+		}
+	}
+
+	return relabeled, nil
+}
+
+// Build the rules owned by from with descriptions marking them as owned by to
+// instead, one rule per source. If selected isn't nil, only the rules for the
+// CIDRs in it are included.
+func relabelPermissions(permissions []*ec2.IpPermission, from *ownerIdentity, to *ownerIdentity, selected map[string]bool) []*ec2.IpPermission {
+	entries := make([]*RuleEntry, 0)
+	for _, entry := range ruleEntriesFromOwnedRules(filterInboundRules(permissions, from, true)) {
+		if selected == nil || selected[entry.IP] {
+			entry.OwnerID = to.ID
+			entries = append(entries, entry)
+		}
+	}
+
+	return ruleEntriesToIpPermissions(entries, to.descriptionFor)
+}
@@ -0,0 +1,91 @@
+package awsclient
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestRelabelPermissions(t *testing.T) {
+	from := &ownerIdentity{ID: "old"}
+	to := &ownerIdentity{ID: "new"}
+	permissions := []*ec2.IpPermission{
+		&ec2.IpPermission{
+			FromPort:   aws.Int64(80),
+			ToPort:     aws.Int64(80),
+			IpProtocol: aws.String("tcp"),
+			IpRanges: []*ec2.IpRange{
+				&ec2.IpRange{CidrIp: aws.String("10.0.0.1/32"), Description: aws.String("ownerid=old ; nodename=node1")},
+				&ec2.IpRange{CidrIp: aws.String("10.0.0.2/32"), Description: aws.String("ownerid=other ; nodename=node2")},
+				&ec2.IpRange{CidrIp: aws.String("10.0.0.3/32"), Description: aws.String("office")},
+			},
+		},
+	}
+
+	rules := relabelPermissions(permissions, from, to, nil)
+	if len(rules) != 1 || len(rules[0].IpRanges) != 1 {
+		t.Fatalf("Expected a single relabeled rule, got %v", rules)
+	}
+
+	entry := RuleEntryFromDescription(rules[0].IpRanges[0].Description)
+	if aws.StringValue(rules[0].IpRanges[0].CidrIp) != "10.0.0.1/32" || entry == nil ||
+		entry.OwnerID != "new" || entry.NodeName != "node1" || aws.Int64Value(rules[0].FromPort) != 80 {
+		t.Errorf("Unexpected relabeled rule %v", rules[0])
+	}
+}
+
+func TestRelabelSelected(t *testing.T) {
+	from := &ownerIdentity{ID: "blue"}
+	to := &ownerIdentity{ID: "green"}
+	permissions := []*ec2.IpPermission{
+		&ec2.IpPermission{
+			FromPort:   aws.Int64(80),
+			ToPort:     aws.Int64(80),
+			IpProtocol: aws.String("tcp"),
+			IpRanges: []*ec2.IpRange{
+				&ec2.IpRange{CidrIp: aws.String("10.0.0.1/32"), Description: aws.String("ownerid=blue ; nodename=node1")},
+				&ec2.IpRange{CidrIp: aws.String("10.0.0.2/32"), Description: aws.String("ownerid=blue ; nodename=node2")},
+			},
+		},
+	}
+
+	rules := relabelPermissions(permissions, from, to, map[string]bool{"10.0.0.2/32": true})
+	if len(rules) != 1 || len(rules[0].IpRanges) != 1 || aws.StringValue(rules[0].IpRanges[0].CidrIp) != "10.0.0.2/32" {
+		t.Errorf("Expected only 10.0.0.2/32 to be relabeled, got %v", rules)
+	}
+}
+
+func TestNormalizeCIDR(t *testing.T) {
+	cases := map[string]string{
+		"203.0.113.10":    "203.0.113.10/32",
+		"203.0.113.10/32": "203.0.113.10/32",
+		"203.0.113.10/24": "203.0.113.0/24",
+		"2001:DB8::1":     "2001:db8::1/128",
+		"2001:db8::/64":   "2001:db8::/64",
+	}
+	for value, expected := range cases {
+		cidr, err := NormalizeCIDR(value)
+		if err != nil || cidr != expected {
+			t.Errorf("Expected %s to become %s, got %s, %v", value, expected, cidr, err)
+		}
+	}
+
+	for _, value := range []string{"", "203.0.113", "203.0.113.10/33", "node1"} {
+		if _, err := NormalizeCIDR(value); err == nil {
+			t.Errorf("Expected %q to be refused", value)
+		}
+	}
+}
+
+func TestCheckRelabelable(t *testing.T) {
+	group := AwsContext{Target: Target{SecurityGroupID: "sg-1"}}
+	if err := group.CheckRelabelable(); err != nil {
+		t.Errorf("Expected a security group to be relabelable, got %s", err)
+	}
+
+	prefixList := AwsContext{Target: Target{PrefixListID: "pl-1"}}
+	if err := prefixList.CheckRelabelable(); err == nil {
+		t.Errorf("Expected a prefix list to be refused")
+	}
+}
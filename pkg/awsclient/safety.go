@@ -0,0 +1,99 @@
+package awsclient
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// By default a single reconcile may remove at most this share of the owned
+// entries of a target.
+const defaultMaxShrinkPercent = 50
+
+// Limits on how many owned entries a single reconcile is allowed to remove.
+// An empty node list from a misbehaving Kubernetes API would otherwise remove
+// every owned rule in one go.
+type SafetyConfig struct {
+	// Refuse to remove more than this percentage of the owned entries of a
+	// target at once. 100 disables the check.
+	MaxShrinkPercent int
+
+	// Apply every change regardless of the checks above, including
+	// removing all owned entries.
+	Override bool
+}
+
+// Load the SafetyConfig from the environment.
+func SafetyConfigFromEnv() (SafetyConfig, error) {
+	config := SafetyConfig{MaxShrinkPercent: defaultMaxShrinkPercent}
+
+	if value := os.Getenv("AWS_SGMANAGER_MAX_SHRINK_PERCENT"); value != "" {
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 1 || percent > 100 {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_MAX_SHRINK_PERCENT value: %s", value)
+		}
+		config.MaxShrinkPercent = percent
+	}
+
+	if value := os.Getenv("AWS_SGMANAGER_SAFETY_OVERRIDE"); value != "" {
+		override, err := strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_SAFETY_OVERRIDE value: %s", value)
+		}
+		config.Override = override
+	}
+
+	return config, nil
+}
+
+// Returned instead of applying a change that the SafetyConfig doesn't allow.
+// Nothing has been changed when this is returned.
+type BlockedChangeError struct {
+	Target  Target
+	Current int
+	Desired int
+
+	// Either "empty" or "shrink".
+	Reason string
+}
+
+func (e *BlockedChangeError) Error() string {
+	if e.Reason == "empty" {
+		return fmt.Sprintf("Refusing to remove all %d owned entries of %s, set AWS_SGMANAGER_SAFETY_OVERRIDE=true if this is intended",
+			e.Current, e.Target)
+	}
+
+	return fmt.Sprintf("Refusing to shrink the owned entries of %s from %d to %d, set AWS_SGMANAGER_SAFETY_OVERRIDE=true if this is intended",
+		e.Target, e.Current, e.Desired)
+}
+
+// Check whether going from current to desired owned entries is allowed.
+func (a *AwsContext) checkSafety(current int, desired int) error {
+	if a.Safety.Override || desired >= current {
+		return nil
+	}
+
+	if desired == 0 {
+		return &BlockedChangeError{Target: a.Target, Current: current, Desired: desired, Reason: "empty"}
+	}
+
+	maxShrink := a.Safety.MaxShrinkPercent
+	if maxShrink == 0 {
+		maxShrink = defaultMaxShrinkPercent
+	}
+	if (current-desired)*100 > current*maxShrink {
+		return &BlockedChangeError{Target: a.Target, Current: current, Desired: desired, Reason: "shrink"}
+	}
+
+	return nil
+}
+
+// Count the distinct rules a set of entries turns into.
+func countDistinctEntries(entries []*RuleEntry) int {
+	keys := make(map[string]bool)
+	for _, entry := range entries {
+		keys[entry.key()] = true
+	}
+
+	return len(keys)
+}
@@ -0,0 +1,31 @@
+package awsclient
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckSafety(t *testing.T) {
+	a := AwsContext{Target: Target{SecurityGroupID: "sg-1"}, Safety: SafetyConfig{MaxShrinkPercent: 50}}
+
+	allowed := [][2]int{{0, 0}, {0, 5}, {10, 10}, {10, 20}, {10, 5}, {3, 2}}
+	for _, counts := range allowed {
+		if err := a.checkSafety(counts[0], counts[1]); err != nil {
+			t.Errorf("Expected going from %d to %d entries to be allowed, got %s", counts[0], counts[1], err)
+		}
+	}
+
+	blocked := map[[2]int]string{{10, 0}: "empty", {1, 0}: "empty", {10, 4}: "shrink", {3, 1}: "shrink"}
+	for counts, reason := range blocked {
+		err := a.checkSafety(counts[0], counts[1])
+		var blockedErr *BlockedChangeError
+		if !errors.As(err, &blockedErr) || blockedErr.Reason != reason {
+			t.Errorf("Expected going from %d to %d entries to be blocked for %s, got %v", counts[0], counts[1], reason, err)
+		}
+	}
+
+	a.Safety.Override = true
+	if err := a.checkSafety(10, 0); err != nil {
+		t.Errorf("Expected the override to allow removing everything, got %s", err)
+	}
+}
@@ -0,0 +1,226 @@
+package awsclient
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Name of the description field and the rule tag holding a signature.
+const (
+	signatureFieldName = "sig"
+	SignatureTagKey    = "aws-securitygroup-manager/signature"
+	signatureLength    = 32
+	signatureVersion   = "v2"
+
+	// Signatures of this version only cover the CIDR of a rule, so the
+	// marker of one rule also verified on another rule for the same CIDR.
+	legacySignatureVersion = "v1"
+)
+
+// Settings for signing ownership markers.
+type SigningConfig struct {
+	// Secret used to sign markers. Signing is disabled when empty.
+	Key []byte
+
+	// Treat markers without any signature as owned. This is meant for
+	// migrating rules that were written before signing was enabled, since
+	// those get replaced with signed ones.
+	AcceptUnsigned bool
+}
+
+// Load the SigningConfig from the environment.
+func SigningConfigFromEnv() (SigningConfig, error) {
+	var config SigningConfig
+	config.Key = []byte(os.Getenv("AWS_SGMANAGER_SIGNING_KEY"))
+
+	if value := os.Getenv("AWS_SGMANAGER_ACCEPT_UNSIGNED"); value != "" {
+		acceptUnsigned, err := strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_ACCEPT_UNSIGNED value: %s", value)
+		}
+		config.AcceptUnsigned = acceptUnsigned
+	}
+
+	return config, nil
+}
+
+// How a rule relates to the current OwnerID.
+type ruleOwnership int
+
+const (
+	// The rule belongs to someone else, or to no one.
+	ruleForeign ruleOwnership = iota
+
+	// The rule is ours.
+	ruleOwned
+
+	// The rule claims to be ours but its signature doesn't check out. It
+	// is treated like a foreign rule, so it's never changed or removed.
+	ruleSpoofed
+)
+
+// Everything needed to decide whether a marker is ours and to write markers
+// that will be recognized as ours later on.
+type ownerIdentity struct {
+	ID      string
+	Signing SigningConfig
+
+	// Until when rules without owner tags are judged by their description
+	// marker in the tags mode.
+	TagsMigrationUntil time.Time
+}
+
+// The identity used for ownership checks in this context.
+func (a *AwsContext) identity() *ownerIdentity {
+	return a.identityOf(a.OwnerID)
+}
+
+// The identity of another owner ID, checked with the same settings.
+func (a *AwsContext) identityOf(ownerID string) *ownerIdentity {
+	return &ownerIdentity{ID: ownerID, Signing: a.Signing, TagsMigrationUntil: a.TagsMigrationUntil}
+}
+
+// Compute the signature over an owner ID, node name and the rule the marker
+// is on, that is its protocol, port range and CIDR, so that a marker copied
+// onto any other rule doesn't verify. Prefix list entries only have a CIDR,
+// see signedPrefixListEntry.
+func (o *ownerIdentity) sign(ownerID string, nodeName string, rule *RuleEntry) string {
+	return o.mac(fmt.Sprintf("%s\n%s\n%s\n%s", signatureVersion, ownerID, nodeName, rule.key()))
+}
+
+// Compute the signature the way markers of the legacy version were signed,
+// over the CIDR of the rule alone.
+func (o *ownerIdentity) signLegacy(ownerID string, nodeName string, rule *RuleEntry) string {
+	return o.mac(fmt.Sprintf("%s\n%s\n%s\n%s", legacySignatureVersion, ownerID, nodeName, rule.IP))
+}
+
+func (o *ownerIdentity) mac(payload string) string {
+	mac := hmac.New(sha256.New, o.Signing.Key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))[:signatureLength]
+}
+
+// Check the signature of a marker on rule that claims to be ours.
+func (o *ownerIdentity) checkSignature(signature string, nodeName string, rule *RuleEntry) ruleOwnership {
+	if len(o.Signing.Key) == 0 {
+		return ruleOwned
+	}
+
+	if signature == "" {
+		if o.Signing.AcceptUnsigned {
+			return ruleOwned
+		}
+		return ruleSpoofed
+	}
+
+	if hmac.Equal([]byte(signature), []byte(o.sign(o.ID, nodeName, rule))) {
+		return ruleOwned
+	}
+
+	// a legacy signature already covers all there is to a prefix list
+	// entry. On a security group rule it's only trusted while migrating,
+	// like a missing one, and gets replaced by a current one.
+	if (rule.Protocol == "" || o.Signing.AcceptUnsigned) &&
+		hmac.Equal([]byte(signature), []byte(o.signLegacy(o.ID, nodeName, rule))) {
+		return ruleOwned
+	}
+
+	return ruleSpoofed
+}
+
+// Decide how rule relates to us by the description it carries. Only the
+// protocol, ports and CIDR of rule are used.
+func (o *ownerIdentity) classifyDescription(description *string, rule *RuleEntry) ruleOwnership {
+	parsed := ParseDescriptionFields(description)
+	if parsed == nil || !parsed.MatchesOwner(o.ID) {
+		return ruleForeign
+	}
+
+	return o.checkSignature(parsed.Fields[signatureFieldName], parsed.NodeName, rule)
+}
+
+// Decide how a rule relates to us by its ownership tags. Rules without an
+// owner tag, such as those created before switching to the tags mode, are
+// foreign, unless the tags migration is still running, in which case they are
+// judged by their description marker. Anyone able to edit a description could
+// otherwise hand a rule to us.
+func (o *ownerIdentity) classifyTaggedRule(rule *ec2.SecurityGroupRule) ruleOwnership {
+	entry := ruleEntryFromTaggedRule(rule)
+	if entry == nil {
+		return ruleForeign
+	}
+
+	if !hasOwnerTag(rule) {
+		if !time.Now().Before(o.TagsMigrationUntil) {
+			return ruleForeign
+		}
+		return o.classifyDescription(rule.Description, entry)
+	}
+
+	if entry.OwnerID != o.ID {
+		return ruleForeign
+	}
+
+	return o.checkSignature(ruleSignature(rule), entry.NodeName, entry)
+}
+
+// Get the signature tag of a rule, or an empty string if it has none.
+func ruleSignature(rule *ec2.SecurityGroupRule) string {
+	for _, tag := range rule.Tags {
+		if aws.StringValue(tag.Key) == SignatureTagKey {
+			return aws.StringValue(tag.Value)
+		}
+	}
+
+	return ""
+}
+
+// Check whether the signature tag of rule is the one tagsFor writes for
+// entry. Rules whose signature is missing or of the legacy version, which
+// are only owned while migrating, are signed again when it isn't.
+func (o *ownerIdentity) hasCurrentSignature(rule *ec2.SecurityGroupRule, entry *RuleEntry) bool {
+	if len(o.Signing.Key) == 0 {
+		return true
+	}
+
+	return ruleSignature(rule) == o.sign(entry.OwnerID, entry.NodeName, entry)
+}
+
+// Create the description marker for an entry, signed if signing is enabled.
+// The signature covers the node name as it ends up being stored, which may
+// have been shortened to fit.
+func (o *ownerIdentity) descriptionFor(entry *RuleEntry) string {
+	description := Description{OwnerID: entry.OwnerID, NodeName: entry.NodeName}
+	if len(o.Signing.Key) == 0 {
+		return description.String()
+	}
+
+	return description.encode(func(storedNodeName string) string {
+		return o.sign(entry.OwnerID, storedNodeName, entry)
+	})
+}
+
+// Create the ownership tags for an entry, signed if signing is enabled.
+func (o *ownerIdentity) tagsFor(entry *RuleEntry) []*ec2.Tag {
+	tags := []*ec2.Tag{
+		&ec2.Tag{Key: aws.String(OwnerTagKey), Value: aws.String(entry.OwnerID)},
+		&ec2.Tag{Key: aws.String(NodeTagKey), Value: aws.String(entry.NodeName)},
+	}
+
+	if len(o.Signing.Key) > 0 {
+		tags = append(tags, &ec2.Tag{
+			Key:   aws.String(SignatureTagKey),
+			Value: aws.String(o.sign(entry.OwnerID, entry.NodeName, entry)),
+		})
+	}
+
+	return tags
+}
@@ -0,0 +1,119 @@
+package awsclient
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestClassifyDescription(t *testing.T) {
+	signed := &ownerIdentity{ID: "owner", Signing: SigningConfig{Key: []byte("secret")}}
+	entry := &RuleEntry{NodeName: "node1", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"}
+	description := signed.descriptionFor(entry)
+
+	if !strings.Contains(description, " sig=") {
+		t.Fatalf("Expected a signature in '%s'", description)
+	}
+	if result := signed.classifyDescription(&description, entry); result != ruleOwned {
+		t.Errorf("Expected a signed description to be owned, got %d", result)
+	}
+
+	// a marker copied onto a rule for another address
+	otherAddress := &RuleEntry{FromPort: 5432, ToPort: 5432, IP: "10.0.0.2/32", Protocol: "tcp"}
+	if result := signed.classifyDescription(&description, otherAddress); result != ruleSpoofed {
+		t.Errorf("Expected a copied description to be spoofed, got %d", result)
+	}
+
+	// a marker copied onto a rule for the same address on another port
+	otherPort := &RuleEntry{FromPort: 22, ToPort: 22, IP: "10.0.0.1/32", Protocol: "tcp"}
+	if result := signed.classifyDescription(&description, otherPort); result != ruleSpoofed {
+		t.Errorf("Expected a description moved to another port to be spoofed, got %d", result)
+	}
+
+	otherKey := &ownerIdentity{ID: "owner", Signing: SigningConfig{Key: []byte("other")}}
+	if result := otherKey.classifyDescription(&description, entry); result != ruleSpoofed {
+		t.Errorf("Expected a description signed with another key to be spoofed, got %d", result)
+	}
+
+	unsigned := entry.GetDescription()
+	if result := signed.classifyDescription(&unsigned, entry); result != ruleSpoofed {
+		t.Errorf("Expected an unsigned description to be spoofed, got %d", result)
+	}
+
+	migrating := &ownerIdentity{ID: "owner", Signing: SigningConfig{Key: []byte("secret"), AcceptUnsigned: true}}
+	if result := migrating.classifyDescription(&unsigned, entry); result != ruleOwned {
+		t.Errorf("Expected an unsigned description to be owned with AcceptUnsigned, got %d", result)
+	}
+
+	foreign := "sgm/v2 owner=someone-else node=node1"
+	if result := signed.classifyDescription(&foreign, entry); result != ruleForeign {
+		t.Errorf("Expected another owner's description to be foreign, got %d", result)
+	}
+
+	// without a key every marker for the owner is accepted, as before
+	plain := &ownerIdentity{ID: "owner"}
+	if result := plain.classifyDescription(&description, otherAddress); result != ruleOwned {
+		t.Errorf("Expected any description to be owned without a key, got %d", result)
+	}
+}
+
+func TestLegacySignature(t *testing.T) {
+	signed := &ownerIdentity{ID: "owner", Signing: SigningConfig{Key: []byte("secret")}}
+	migrating := &ownerIdentity{ID: "owner", Signing: SigningConfig{Key: []byte("secret"), AcceptUnsigned: true}}
+	entry := &RuleEntry{NodeName: "node1", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"}
+	legacy := Description{OwnerID: "owner", NodeName: "node1", Fields: map[string]string{
+		signatureFieldName: signed.signLegacy("owner", "node1", entry),
+	}}
+	description := legacy.String()
+
+	if result := signed.classifyDescription(&description, entry); result != ruleSpoofed {
+		t.Errorf("Expected a legacy signature on a rule to be spoofed, got %d", result)
+	}
+	if result := migrating.classifyDescription(&description, entry); result != ruleOwned {
+		t.Errorf("Expected a legacy signature on a rule to be owned with AcceptUnsigned, got %d", result)
+	}
+
+	// prefix list entries have nothing but their CIDR to sign
+	prefixListEntry := signedPrefixListEntry(entry)
+	if result := signed.classifyDescription(&description, prefixListEntry); result != ruleOwned {
+		t.Errorf("Expected a legacy signature on a prefix list entry to be owned, got %d", result)
+	}
+}
+
+func TestSignedDescriptionLength(t *testing.T) {
+	signed := &ownerIdentity{ID: "owner", Signing: SigningConfig{Key: []byte("secret")}}
+	entry := &RuleEntry{NodeName: strings.Repeat("n", 300), OwnerID: "owner", IP: "10.0.0.1/32"}
+	description := signed.descriptionFor(entry)
+
+	if len(description) > maxDescriptionLength {
+		t.Errorf("Expected at most %d characters, got %d", maxDescriptionLength, len(description))
+	}
+	if result := signed.classifyDescription(&description, entry); result != ruleOwned {
+		t.Errorf("Expected a shortened signed description to be owned, got %d", result)
+	}
+}
+
+func TestClassifyTaggedRule(t *testing.T) {
+	signed := &ownerIdentity{ID: "owner", Signing: SigningConfig{Key: []byte("secret")}}
+	entry := &RuleEntry{NodeName: "node1", OwnerID: "owner", FromPort: 5432, ToPort: 5432, IP: "10.0.0.1/32", Protocol: "tcp"}
+	rule := func(cidr string, port int64, tags []*ec2.Tag) *ec2.SecurityGroupRule {
+		return &ec2.SecurityGroupRule{CidrIpv4: aws.String(cidr), IpProtocol: aws.String("tcp"),
+			FromPort: aws.Int64(port), ToPort: aws.Int64(port), Tags: tags}
+	}
+
+	tags := signed.tagsFor(entry)
+	if result := signed.classifyTaggedRule(rule(entry.IP, 5432, tags)); result != ruleOwned {
+		t.Errorf("Expected a signed rule to be owned, got %d", result)
+	}
+	if result := signed.classifyTaggedRule(rule("10.0.0.2/32", 5432, tags)); result != ruleSpoofed {
+		t.Errorf("Expected copied tags to be spoofed, got %d", result)
+	}
+	if result := signed.classifyTaggedRule(rule(entry.IP, 22, tags)); result != ruleSpoofed {
+		t.Errorf("Expected tags moved to another port to be spoofed, got %d", result)
+	}
+	if result := signed.classifyTaggedRule(rule(entry.IP, 5432, tags[:2])); result != ruleSpoofed {
+		t.Errorf("Expected unsigned tags to be spoofed, got %d", result)
+	}
+}
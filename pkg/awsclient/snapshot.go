@@ -0,0 +1,571 @@
+package awsclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Version of the snapshot format.
+const snapshotVersion = 1
+
+// Number of snapshots a store keeps unless configured otherwise.
+const DefaultSnapshotRetain = 20
+
+// The inbound rules of a security group target and its overflow groups, or
+// the entries of a prefix list target, at one point in time, exactly as
+// returned by AWS.
+type Snapshot struct {
+	Version int       `json:"version"`
+	Name    string    `json:"name"`
+	Time    time.Time `json:"time"`
+	OwnerID string    `json:"ownerId"`
+	Target  Target    `json:"target"`
+
+	// The ownership mode the rules were managed in. Snapshots taken in the
+	// tags mode also hold the ownership tags of the rules.
+	Ownership string `json:"ownership,omitempty"`
+
+	Groups []GroupSnapshot `json:"groups"`
+}
+
+// The inbound rules of a single security group, or the entries of a prefix
+// list.
+type GroupSnapshot struct {
+	GroupID       string              `json:"groupId"`
+	IpPermissions []*ec2.IpPermission `json:"ipPermissions"`
+
+	// The ownership tags of the rules in the tags mode, by rule.
+	RuleTags map[string]map[string]string `json:"ruleTags,omitempty"`
+
+	PrefixListEntries []*ec2.PrefixListEntry `json:"prefixListEntries,omitempty"`
+}
+
+// Keys of the rule tags a snapshot keeps.
+var snapshotTagKeys = []string{OwnerTagKey, NodeTagKey, SignatureTagKey}
+
+// Somewhere snapshots are kept, by name. A store only keeps a limited number
+// of the most recent snapshots.
+type SnapshotStore interface {
+	SaveSnapshot(ctx context.Context, name string, data []byte) error
+	LoadSnapshot(ctx context.Context, name string) ([]byte, error)
+}
+
+// A SnapshotStore keeping every snapshot as a file in a local directory.
+type DirSnapshotStore struct {
+	Dir    string
+	Retain int
+}
+
+func (d *DirSnapshotStore) SaveSnapshot(ctx context.Context, name string, data []byte) error {
+	err := os.MkdirAll(d.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating snapshot directory %s: %w", d.Dir, err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(d.Dir, name+".json"), data, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing snapshot %s: %w", name, err)
+	}
+
+	return d.prune(name)
+}
+
+func (d *DirSnapshotStore) LoadSnapshot(ctx context.Context, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.Dir, name+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading snapshot %s: %w", name, err)
+	}
+
+	return data, nil
+}
+
+// Remove the oldest snapshots of the same target as name beyond the
+// retention limit.
+func (d *DirSnapshotStore) prune(name string) error {
+	files, err := filepath.Glob(filepath.Join(d.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0)
+	for _, file := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(file), ".json"))
+	}
+
+	for _, old := range SnapshotsToPrune(names, name, d.Retain) {
+		err = os.Remove(filepath.Join(d.Dir, old+".json"))
+		if err != nil {
+			return fmt.Errorf("Error removing old snapshot %s: %w", old, err)
+		}
+	}
+
+	return nil
+}
+
+// Get the snapshots among names that should be removed after saving newName
+// to keep at most retain snapshots of the same target. Snapshot names end in
+// a timestamp, so sorting them sorts them by age.
+func SnapshotsToPrune(names []string, newName string, retain int) []string {
+	if retain <= 0 {
+		retain = DefaultSnapshotRetain
+	}
+
+	prefix := snapshotTargetPrefix(newName)
+	sameTarget := make([]string, 0)
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			sameTarget = append(sameTarget, name)
+		}
+	}
+
+	sort.Strings(sameTarget)
+	if len(sameTarget) <= retain {
+		return nil
+	}
+
+	return sameTarget[:len(sameTarget)-retain]
+}
+
+// The part of a snapshot name shared by all snapshots of the same target.
+func snapshotTargetPrefix(name string) string {
+	idx := strings.LastIndexByte(name, '-')
+	if idx < 0 {
+		return name
+	}
+
+	return name[:idx+1]
+}
+
+// Load a snapshot saved by a reconcile or a restore.
+func LoadSnapshot(ctx context.Context, store SnapshotStore, name string) (*Snapshot, error) {
+	data, err := store.LoadSnapshot(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding snapshot %s: %w", name, err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("Snapshot %s has unsupported version %d", name, snapshot.Version)
+	}
+
+	return &snapshot, nil
+}
+
+// Save the inbound rules of every group in the pool, unless they're exactly
+// the same as in the last snapshot this context saved. Nothing is saved if no
+// store is configured.
+func (a *AwsContext) snapshotPool(ctx context.Context, pool []*poolGroup, force bool) error {
+	if a.Snapshots == nil {
+		return nil
+	}
+
+	groups := make([]GroupSnapshot, 0)
+	for _, group := range pool {
+		permissions := group.permissions
+		if permissions == nil {
+			// the tags mode works with individual rules, read them again
+			// in the form the snapshot needs
+			var err error
+			permissions, err = a.getInboundRules(ctx, group.GroupID)
+			if err != nil {
+				return err
+			}
+		}
+
+		snapshot := GroupSnapshot{GroupID: group.GroupID, IpPermissions: permissions}
+		if group.rules != nil {
+			snapshot.RuleTags = snapshotRuleTags(group.rules)
+		}
+		groups = append(groups, snapshot)
+	}
+
+	return a.saveSnapshot(ctx, groups, force)
+}
+
+// Save the entries of the prefix list target like snapshotPool saves the
+// rules of a security group target.
+func (a *AwsContext) snapshotPrefixList(ctx context.Context, entries []*ec2.PrefixListEntry, force bool) error {
+	if a.Snapshots == nil {
+		return nil
+	}
+
+	return a.saveSnapshot(ctx, []GroupSnapshot{
+		GroupSnapshot{GroupID: a.Target.PrefixListID, PrefixListEntries: entries},
+	}, force)
+}
+
+func (a *AwsContext) saveSnapshot(ctx context.Context, groups []GroupSnapshot, force bool) error {
+	content, err := json.Marshal(groups)
+	if err != nil {
+		return fmt.Errorf("Error encoding snapshot: %w", err)
+	}
+	sum := sha256.Sum256(content)
+	fingerprint := hex.EncodeToString(sum[:])
+	if !force && fingerprint == a.lastSnapshotFingerprint {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	snapshot := Snapshot{
+		Version:   snapshotVersion,
+		Name:      fmt.Sprintf("%s-%s", a.targetResourceID(), now.Format("20060102T150405.000Z")),
+		Time:      now,
+		OwnerID:   a.OwnerID,
+		Target:    a.Target,
+		Ownership: a.Ownership,
+		Groups:    groups,
+	}
+
+	data, err := json.MarshalIndent(&snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding snapshot: %w", err)
+	}
+
+	err = a.Snapshots.SaveSnapshot(ctx, snapshot.Name, data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved snapshot %s of %s\n", snapshot.Name, a.Target)
+	a.lastSnapshotFingerprint = fingerprint
+	return nil
+}
+
+// Get the ownership tags of rules, by rule. Rules without any are left out.
+func snapshotRuleTags(rules []*ec2.SecurityGroupRule) map[string]map[string]string {
+	results := make(map[string]map[string]string)
+	for _, rule := range rules {
+		tags := ownershipTagValues(rule)
+		if len(tags) > 0 {
+			results[securityGroupRuleKey(rule)] = tags
+		}
+	}
+
+	return results
+}
+
+func ownershipTagValues(rule *ec2.SecurityGroupRule) map[string]string {
+	results := make(map[string]string)
+	for _, tag := range rule.Tags {
+		for _, key := range snapshotTagKeys {
+			if aws.StringValue(tag.Key) == key {
+				results[key] = aws.StringValue(tag.Value)
+			}
+		}
+	}
+
+	return results
+}
+
+// Bring every group of the snapshot back to exactly the rules it had,
+// including rules owned by someone else. The current rules are snapshotted
+// first, so that a restore can be undone as well. Descriptions are fixed
+// and missing rules added before extra rules are removed.
+func (a *AwsContext) RestoreSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	ctx, flushAudit := a.bufferAudit(ctx)
+	defer flushAudit()
+
+	if a.Target.PrefixListID != "" {
+		return a.restorePrefixList(ctx, snapshot)
+	}
+
+	pool := make([]*poolGroup, 0)
+	for _, group := range snapshot.Groups {
+		permissions, err := a.getInboundRules(ctx, group.GroupID)
+		if err != nil {
+			return fmt.Errorf("RestoreSnapshot error: %w", err)
+		}
+		state := &groupState{GroupID: group.GroupID, permissions: permissions}
+		if a.Ownership == OwnershipTags {
+			// keep the current tags in the snapshot taken before
+			// restoring
+			tagged, err := (&tagOwnership{a}).getGroupState(ctx, group.GroupID)
+			if err != nil {
+				return fmt.Errorf("RestoreSnapshot error: %w", err)
+			}
+			state.rules = tagged.rules
+		}
+		pool = append(pool, &poolGroup{groupState: state})
+	}
+
+	err := a.snapshotPool(ctx, pool, true)
+	if err != nil {
+		return fmt.Errorf("RestoreSnapshot error while saving the current rules: %w", err)
+	}
+
+	for idx, group := range snapshot.Groups {
+		changes := diffSnapshotGroup(pool[idx].permissions, group.IpPermissions)
+		fmt.Printf("Restoring %s: %d rules to add, %d to remove, %d descriptions to fix\n", group.GroupID,
+			len(changes.authorize), len(changes.revoke), len(changes.describe))
+
+		err = a.updateRuleDescriptions(ctx, group.GroupID, changes.describe)
+		if err != nil {
+			return fmt.Errorf("RestoreSnapshot error in %s: %w", group.GroupID, err)
+		}
+
+		err = a.setInboundRules(ctx, group.GroupID, changes.authorize)
+		if err != nil {
+			return fmt.Errorf("RestoreSnapshot error in %s: %w", group.GroupID, err)
+		}
+
+		// rules are added without tags, so they're tagged right after,
+		// before anything is removed
+		if snapshot.Ownership == OwnershipTags {
+			err = a.restoreRuleTags(ctx, group.GroupID, group.RuleTags)
+			if err != nil {
+				return fmt.Errorf("RestoreSnapshot error in %s: %w", group.GroupID, err)
+			}
+		}
+
+		err = a.deleteInboundRules(ctx, group.GroupID, changes.revoke)
+		if err != nil {
+			return fmt.Errorf("RestoreSnapshot error in %s: %w", group.GroupID, err)
+		}
+	}
+
+	return nil
+}
+
+// Bring the ownership tags of the rules in a group back to the ones saved in
+// a snapshot.
+func (a *AwsContext) restoreRuleTags(ctx context.Context, groupID string, saved map[string]map[string]string) error {
+	state, err := (&tagOwnership{a}).getGroupState(ctx, groupID)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range state.rules {
+		ruleID := aws.StringValue(rule.SecurityGroupRuleId)
+		create, remove := diffRuleTags(ownershipTagValues(rule), saved[securityGroupRuleKey(rule)])
+
+		if len(create) > 0 {
+			var requestID string
+			_, err = a.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+				Resources: []*string{rule.SecurityGroupRuleId},
+				Tags:      create,
+			}, captureRequestID(&requestID))
+			a.audit(ctx, groupID, AuditUpdateTags, []string{ruleID + " " + auditTags(create)}, nil, requestID, err)
+			if err != nil {
+				return fmt.Errorf("Error tagging rule %s: %w", ruleID, err)
+			}
+		}
+
+		if len(remove) > 0 {
+			var requestID string
+			_, err = a.ec2.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+				Resources: []*string{rule.SecurityGroupRuleId},
+				Tags:      remove,
+			}, captureRequestID(&requestID))
+			a.audit(ctx, groupID, AuditUpdateTags, nil, []string{ruleID + " " + auditTags(remove)}, requestID, err)
+			if err != nil {
+				return fmt.Errorf("Error removing tags from rule %s: %w", ruleID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Work out the tags to set and the tags to remove to turn the ownership tags
+// current into saved.
+func diffRuleTags(current map[string]string, saved map[string]string) ([]*ec2.Tag, []*ec2.Tag) {
+	create := make([]*ec2.Tag, 0)
+	remove := make([]*ec2.Tag, 0)
+	for _, key := range snapshotTagKeys {
+		value, wanted := saved[key]
+		existing, present := current[key]
+		switch {
+		case wanted && (!present || existing != value):
+			create = append(create, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+		case !wanted && present:
+			remove = append(remove, &ec2.Tag{Key: aws.String(key)})
+		}
+	}
+
+	return create, remove
+}
+
+func auditTags(tags []*ec2.Tag) string {
+	parts := make([]string, 0)
+	for _, tag := range tags {
+		if tag.Value == nil {
+			parts = append(parts, aws.StringValue(tag.Key))
+		} else {
+			parts = append(parts, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Bring the prefix list target back to exactly the entries in a snapshot.
+// Entries whose description differs are removed and added again in a later
+// version of the list, since their description can't be changed in place.
+func (a *AwsContext) restorePrefixList(ctx context.Context, snapshot *Snapshot) error {
+	if len(snapshot.Groups) != 1 || snapshot.Groups[0].GroupID != a.Target.PrefixListID {
+		return fmt.Errorf("RestoreSnapshot error: snapshot %s doesn't hold prefix list %s", snapshot.Name, a.Target.PrefixListID)
+	}
+
+	prefixList, err := a.waitForPrefixList(ctx)
+	if err != nil {
+		return fmt.Errorf("RestoreSnapshot error: %w", err)
+	}
+
+	current, err := a.getPrefixListEntries(ctx, aws.Int64Value(prefixList.Version))
+	if err != nil {
+		return fmt.Errorf("RestoreSnapshot error: %w", err)
+	}
+
+	err = a.snapshotPrefixList(ctx, current, true)
+	if err != nil {
+		return fmt.Errorf("RestoreSnapshot error while saving the current entries: %w", err)
+	}
+
+	changes := diffSnapshotPrefixList(current, snapshot.Groups[0].PrefixListEntries)
+	fmt.Printf("Restoring %s: %d entries to add, %d to remove\n", a.Target.PrefixListID, len(changes.Add), len(changes.Remove))
+	if changes.empty() {
+		return nil
+	}
+
+	// entries whose description changed are removed and added back, which
+	// drops their address until the addition goes through
+	if readded := readdedPrefixListEntries(changes); len(readded) > 0 {
+		fmt.Printf("Warning: %s will be left out of prefix list %s until they are added back with their old description\n",
+			strings.Join(readded, ", "), a.Target.PrefixListID)
+	}
+
+	err = a.applyPrefixListChanges(ctx, prefixList, len(current), changes)
+	if err != nil {
+		return fmt.Errorf("RestoreSnapshot error: %w", err)
+	}
+
+	return nil
+}
+
+// Work out the changes that bring the prefix list back to the saved entries.
+// An entry whose description differs from the saved one is both removed and
+// added, since ModifyManagedPrefixList can't change a description in place.
+func diffSnapshotPrefixList(current []*ec2.PrefixListEntry, saved []*ec2.PrefixListEntry) *prefixListChanges {
+	var changes prefixListChanges
+
+	currentByCidr := make(map[string]*ec2.PrefixListEntry)
+	for _, entry := range current {
+		currentByCidr[aws.StringValue(entry.Cidr)] = entry
+	}
+
+	savedCidrs := make(map[string]bool)
+	for _, entry := range saved {
+		cidr := aws.StringValue(entry.Cidr)
+		savedCidrs[cidr] = true
+
+		existing, ok := currentByCidr[cidr]
+		if ok && aws.StringValue(existing.Description) == aws.StringValue(entry.Description) {
+			continue
+		}
+		if ok {
+			changes.Remove = append(changes.Remove, &ec2.RemovePrefixListEntry{Cidr: entry.Cidr})
+		}
+		changes.Add = append(changes.Add, &ec2.AddPrefixListEntry{Cidr: entry.Cidr, Description: entry.Description})
+	}
+
+	for _, entry := range current {
+		if !savedCidrs[aws.StringValue(entry.Cidr)] {
+			changes.Remove = append(changes.Remove, &ec2.RemovePrefixListEntry{Cidr: entry.Cidr})
+		}
+	}
+
+	return &changes
+}
+
+// The changes that bring one group back to a snapshot, as expanded rules.
+type snapshotChanges struct {
+	authorize []*ec2.IpPermission
+	revoke    []*ec2.IpPermission
+	describe  []*ec2.IpPermission
+}
+
+func diffSnapshotGroup(current []*ec2.IpPermission, saved []*ec2.IpPermission) *snapshotChanges {
+	var changes snapshotChanges
+
+	currentByKey := make(map[string]*ec2.IpPermission)
+	for _, rule := range expandRules(current) {
+		currentByKey[permissionKey(rule)] = rule
+	}
+
+	savedKeys := make(map[string]bool)
+	for _, rule := range expandRules(saved) {
+		key := permissionKey(rule)
+		savedKeys[key] = true
+
+		existing, ok := currentByKey[key]
+		if !ok {
+			changes.authorize = append(changes.authorize, rule)
+		} else if ruleDescription(existing) != ruleDescription(rule) {
+			changes.describe = append(changes.describe, rule)
+		}
+	}
+
+	for _, rule := range expandRules(current) {
+		if !savedKeys[permissionKey(rule)] {
+			changes.revoke = append(changes.revoke, rule)
+		}
+	}
+
+	return &changes
+}
+
+// Set the descriptions of existing rules to the ones in rules.
+func (a *AwsContext) updateRuleDescriptions(ctx context.Context, groupID string, rules []*ec2.IpPermission) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	rules = expandRules(rules)
+	return a.inBatches(groupID, "UpdateDescriptions", len(rules), func(start int, end int) error {
+		batch := rules[start:end]
+		var requestID string
+		_, err := a.ec2.UpdateSecurityGroupRuleDescriptionsIngressWithContext(ctx, &ec2.UpdateSecurityGroupRuleDescriptionsIngressInput{
+			GroupId:       aws.String(groupID),
+			IpPermissions: batch,
+		}, captureRequestID(&requestID))
+		a.audit(ctx, groupID, AuditUpdateDescription, auditRules(batch), nil, requestID, err)
+		if err != nil {
+			return fmt.Errorf("Error updating rule descriptions in %s: %w", groupID, err)
+		}
+
+		return nil
+	})
+}
+
+// Get the CIDRs that changes both remove and add again.
+func readdedPrefixListEntries(changes *prefixListChanges) []string {
+	removed := make(map[string]bool)
+	for _, entry := range changes.Remove {
+		removed[aws.StringValue(entry.Cidr)] = true
+	}
+
+	results := make([]string, 0)
+	for _, entry := range changes.Add {
+		if removed[aws.StringValue(entry.Cidr)] {
+			results = append(results, aws.StringValue(entry.Cidr))
+		}
+	}
+
+	return results
+}
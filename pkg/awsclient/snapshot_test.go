@@ -0,0 +1,131 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestDiffSnapshotGroup(t *testing.T) {
+	rule := func(cidr string, description string) *ec2.IpPermission {
+		return &ec2.IpPermission{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int64(5432),
+			ToPort:     aws.Int64(5432),
+			IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String(cidr), Description: aws.String(description)}},
+		}
+	}
+	pair := &ec2.IpPermission{
+		IpProtocol:       aws.String("-1"),
+		UserIdGroupPairs: []*ec2.UserIdGroupPair{&ec2.UserIdGroupPair{GroupId: aws.String("sg-5678")}},
+	}
+
+	saved := []*ec2.IpPermission{rule("10.0.0.1/32", "kept"), rule("10.0.0.2/32", "original"), rule("10.0.0.3/32", "removed"), pair}
+	current := []*ec2.IpPermission{rule("10.0.0.1/32", "kept"), rule("10.0.0.2/32", "edited"), rule("10.0.0.4/32", "added")}
+
+	changes := diffSnapshotGroup(current, saved)
+	if len(changes.authorize) != 2 || permissionKey(changes.authorize[0]) != "tcp/5432-5432/10.0.0.3/32" ||
+		changes.authorize[1].UserIdGroupPairs[0] != pair.UserIdGroupPairs[0] {
+		t.Errorf("Expected 10.0.0.3/32 and sg-5678 to be authorized, got %v", changes.authorize)
+	}
+	if len(changes.revoke) != 1 || permissionKey(changes.revoke[0]) != "tcp/5432-5432/10.0.0.4/32" {
+		t.Errorf("Expected 10.0.0.4/32 to be revoked, got %v", changes.revoke)
+	}
+	if len(changes.describe) != 1 || ruleDescription(changes.describe[0]) != "original" {
+		t.Errorf("Expected the description of 10.0.0.2/32 to be restored, got %v", changes.describe)
+	}
+}
+
+func TestDiffSnapshotPrefixList(t *testing.T) {
+	entry := func(cidr string, description string) *ec2.PrefixListEntry {
+		return &ec2.PrefixListEntry{Cidr: aws.String(cidr), Description: aws.String(description)}
+	}
+
+	saved := []*ec2.PrefixListEntry{entry("10.0.0.1/32", "kept"), entry("10.0.0.2/32", "original"), entry("10.0.0.3/32", "removed")}
+	current := []*ec2.PrefixListEntry{entry("10.0.0.1/32", "kept"), entry("10.0.0.2/32", "edited"), entry("10.0.0.4/32", "added")}
+
+	changes := diffSnapshotPrefixList(current, saved)
+	added := auditPrefixListAdditions(changes.Add)
+	if len(added) != 2 || added[0] != "10.0.0.2/32 original" || added[1] != "10.0.0.3/32 removed" {
+		t.Errorf("Expected 10.0.0.2/32 and 10.0.0.3/32 to be added, got %v", added)
+	}
+	removed := auditPrefixListRemovals(changes.Remove)
+	if len(removed) != 2 || removed[0] != "10.0.0.2/32" || removed[1] != "10.0.0.4/32" {
+		t.Errorf("Expected 10.0.0.2/32 and 10.0.0.4/32 to be removed, got %v", removed)
+	}
+	if readded := readdedPrefixListEntries(changes); len(readded) != 1 || readded[0] != "10.0.0.2/32" {
+		t.Errorf("Expected only 10.0.0.2/32 to be added back, got %v", readded)
+	}
+}
+
+func TestDiffRuleTags(t *testing.T) {
+	rule := &ec2.SecurityGroupRule{
+		CidrIpv4:   aws.String("10.0.0.1/32"),
+		IpProtocol: aws.String("tcp"),
+		FromPort:   aws.Int64(5432),
+		ToPort:     aws.Int64(5432),
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String(OwnerTagKey), Value: aws.String("owner")},
+			&ec2.Tag{Key: aws.String(NodeTagKey), Value: aws.String("node1")},
+			&ec2.Tag{Key: aws.String("team"), Value: aws.String("db")},
+		},
+	}
+
+	saved := snapshotRuleTags([]*ec2.SecurityGroupRule{rule})
+	tags, ok := saved["tcp/5432-5432/10.0.0.1/32"]
+	if !ok || len(tags) != 2 || tags[OwnerTagKey] != "owner" || tags[NodeTagKey] != "node1" {
+		t.Fatalf("Expected only the ownership tags to be saved, got %v", saved)
+	}
+
+	create, remove := diffRuleTags(map[string]string{OwnerTagKey: "someone-else", SignatureTagKey: "abc"}, tags)
+	if auditTags(create) != OwnerTagKey+"=owner "+NodeTagKey+"=node1" {
+		t.Errorf("Expected the owner and node tags to be set, got %s", auditTags(create))
+	}
+	if auditTags(remove) != SignatureTagKey {
+		t.Errorf("Expected the signature tag to be removed, got %s", auditTags(remove))
+	}
+
+	create, remove = diffRuleTags(tags, tags)
+	if len(create) != 0 || len(remove) != 0 {
+		t.Errorf("Expected no changes, got %v and %v", create, remove)
+	}
+}
+
+func TestDirSnapshotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &DirSnapshotStore{Dir: dir, Retain: 2}
+	ctx := context.Background()
+	for idx := 1; idx <= 3; idx++ {
+		for _, groupID := range []string{"sg-1", "sg-2"} {
+			name := fmt.Sprintf("%s-2021060%dT120000.000Z", groupID, idx)
+			data := fmt.Sprintf(`{"version": 1, "name": "%s"}`, name)
+			if err := store.SaveSnapshot(ctx, name, []byte(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 4 {
+		t.Errorf("Expected 2 snapshots to be kept per target, got %d files", len(files))
+	}
+
+	if _, err := LoadSnapshot(ctx, store, "sg-1-20210601T120000.000Z"); err == nil {
+		t.Errorf("Expected the oldest snapshot to be pruned")
+	}
+
+	snapshot, err := LoadSnapshot(ctx, store, "sg-2-20210603T120000.000Z")
+	if err != nil || snapshot.Name != "sg-2-20210603T120000.000Z" {
+		t.Errorf("Expected the newest snapshot to load, got %v (%v)", snapshot, err)
+	}
+}
@@ -0,0 +1,190 @@
+package awsclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// A security group or managed prefix list to manage along with how to reach
+// it. Exactly one of SecurityGroupID and PrefixListID is set. Region and
+// RoleARN are optional. When left empty, the region and credentials of the
+// manager itself are used.
+type Target struct {
+	SecurityGroupID string `json:"securityGroupId,omitempty"`
+	PrefixListID    string `json:"prefixListId,omitempty"`
+	Region          string `json:"region,omitempty"`
+	RoleARN         string `json:"roleArn,omitempty"`
+	ExternalID      string `json:"externalId,omitempty"`
+
+	// Allow growing the maximum size of a prefix list when the entries
+	// don't fit anymore.
+	AllowResize bool `json:"allowResize,omitempty"`
+}
+
+func (t Target) String() string {
+	if t.PrefixListID != "" {
+		return fmt.Sprintf("Target{PrefixListID: %s, Region: %s, RoleARN: %s}",
+			t.PrefixListID, t.Region, t.RoleARN)
+	}
+
+	return fmt.Sprintf("Target{SecurityGroupID: %s, Region: %s, RoleARN: %s}",
+		t.SecurityGroupID, t.Region, t.RoleARN)
+}
+
+// Load the list of targets. AWS_SGMANAGER_TARGETS holds a JSON list of Target
+// objects. If it isn't set, a single target is built from
+// AWS_SECURITY_GROUP_ID instead.
+func TargetsFromEnv() ([]Target, error) {
+	targetsJSON := os.Getenv("AWS_SGMANAGER_TARGETS")
+	if targetsJSON == "" {
+		sgid := os.Getenv("AWS_SECURITY_GROUP_ID")
+		if sgid == "" {
+			return nil, fmt.Errorf("Env var AWS_SGMANAGER_TARGETS or AWS_SECURITY_GROUP_ID must be set")
+		}
+
+		return []Target{Target{SecurityGroupID: sgid}}, nil
+	}
+
+	var targets []Target
+	err := json.Unmarshal([]byte(targetsJSON), &targets)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse AWS_SGMANAGER_TARGETS: %w", err)
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("AWS_SGMANAGER_TARGETS is empty")
+	}
+
+	for idx, target := range targets {
+		if (target.SecurityGroupID == "") == (target.PrefixListID == "") {
+			return nil, fmt.Errorf("AWS_SGMANAGER_TARGETS entry %d needs exactly one of securityGroupId and prefixListId", idx)
+		}
+	}
+
+	return targets, nil
+}
+
+// Identifies a set of assumed role credentials.
+type roleKey struct {
+	roleARN    string
+	externalID string
+}
+
+// Identifies a session, which is a set of credentials used in a region.
+type sessionKey struct {
+	role   roleKey
+	region string
+}
+
+// Hands out sessions and EC2 clients for targets. Credentials are cached per
+// role so that targets sharing an account don't each call STS, and each set
+// refreshes itself when it is about to expire. EC2 clients are pooled per
+// region and role so targets in the same place share one.
+type SessionCache struct {
+	mutex       sync.Mutex
+	base        *session.Session
+	sessionName string
+	credentials map[roleKey]*credentials.Credentials
+	sessions    map[sessionKey]*session.Session
+	ec2Clients  map[sessionKey]*ec2.EC2
+}
+
+// Create a SessionCache whose base session comes from the SDK default chain,
+// optionally with assumeRole applied on top of it.
+func NewSessionCache(assumeRole *AssumeRoleConfig) (*SessionCache, error) {
+	base, err := newSession(assumeRole)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing AWS Session: %w", err)
+	}
+
+	sessionName := defaultRoleSessionName
+	if assumeRole != nil {
+		sessionName = assumeRole.SessionName
+	}
+
+	return &SessionCache{
+		base:        base,
+		sessionName: sessionName,
+		credentials: make(map[roleKey]*credentials.Credentials),
+		sessions:    make(map[sessionKey]*session.Session),
+		ec2Clients:  make(map[sessionKey]*ec2.EC2),
+	}, nil
+}
+
+func keyForTarget(target Target) sessionKey {
+	return sessionKey{
+		role:   roleKey{roleARN: target.RoleARN, externalID: target.ExternalID},
+		region: target.Region,
+	}
+}
+
+// Get the session to use for a target, creating it if necessary.
+func (c *SessionCache) SessionFor(target Target) *session.Session {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.sessionFor(keyForTarget(target))
+}
+
+// Get the EC2 client to use for a target, creating it if necessary.
+func (c *SessionCache) EC2For(target Target) *ec2.EC2 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := keyForTarget(target)
+	if client, ok := c.ec2Clients[key]; ok {
+		return client
+	}
+
+	client := ec2.New(c.sessionFor(key))
+	c.ec2Clients[key] = client
+	return client
+}
+
+// Region that a session without an explicit region ends up using.
+func (c *SessionCache) DefaultRegion() string {
+	return aws.StringValue(c.base.Config.Region)
+}
+
+func (c *SessionCache) sessionFor(key sessionKey) *session.Session {
+	if sess, ok := c.sessions[key]; ok {
+		return sess
+	}
+
+	config := aws.NewConfig()
+	if key.region != "" {
+		config.WithRegion(key.region)
+	}
+
+	if key.role.roleARN != "" {
+		creds, ok := c.credentials[key.role]
+		if !ok {
+			creds = assumeRoleCredentials(c.base, key.role.roleARN, key.role.externalID, c.sessionName)
+			c.credentials[key.role] = creds
+		}
+		config.WithCredentials(creds)
+	}
+
+	sess := c.base.Copy(config)
+	c.sessions[key] = sess
+	return sess
+}
+
+// Group AwsContext objects by the region they talk to so that each region can
+// be reconciled on its own.
+func GroupByRegion(contexts []*AwsContext) map[string][]*AwsContext {
+	results := make(map[string][]*AwsContext)
+	for _, a := range contexts {
+		region := a.Region()
+		results[region] = append(results[region], a)
+	}
+
+	return results
+}
@@ -0,0 +1,111 @@
+package awsclient
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTargetsFromEnv(t *testing.T) {
+	defer os.Setenv("AWS_SGMANAGER_TARGETS", os.Getenv("AWS_SGMANAGER_TARGETS"))
+	defer os.Setenv("AWS_SECURITY_GROUP_ID", os.Getenv("AWS_SECURITY_GROUP_ID"))
+
+	t.Run("Fall back to AWS_SECURITY_GROUP_ID", func(t *testing.T) {
+		os.Setenv("AWS_SGMANAGER_TARGETS", "")
+		os.Setenv("AWS_SECURITY_GROUP_ID", "sg-12345")
+
+		targets, err := TargetsFromEnv()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(targets) != 1 || targets[0] != (Target{SecurityGroupID: "sg-12345"}) {
+			t.Errorf("Expected a single target for sg-12345, got %v", targets)
+		}
+	})
+
+	t.Run("Targets from JSON", func(t *testing.T) {
+		os.Setenv("AWS_SGMANAGER_TARGETS", `[
+			{"securityGroupId": "sg-1"},
+			{"securityGroupId": "sg-2", "region": "eu-west-1", "roleArn": "arn:aws:iam::123456789012:role/sgm", "externalId": "abc"}
+		]`)
+
+		targets, err := TargetsFromEnv()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		expected := []Target{
+			Target{SecurityGroupID: "sg-1"},
+			Target{SecurityGroupID: "sg-2", Region: "eu-west-1", RoleARN: "arn:aws:iam::123456789012:role/sgm", ExternalID: "abc"},
+		}
+		if len(targets) != len(expected) {
+			t.Fatalf("Expected %d targets, got %d", len(expected), len(targets))
+		}
+		for idx := range expected {
+			if targets[idx] != expected[idx] {
+				t.Errorf("Target %d is %s, expected %s", idx, targets[idx], expected[idx])
+			}
+		}
+	})
+
+	t.Run("Invalid targets", func(t *testing.T) {
+		invalid := []string{
+			"not json",
+			"[]",
+			`[{"region": "eu-west-1"}]`,
+		}
+
+		for _, value := range invalid {
+			os.Setenv("AWS_SGMANAGER_TARGETS", value)
+			_, err := TargetsFromEnv()
+			if err == nil {
+				t.Errorf("Expected an error for '%s' but got none", value)
+			}
+		}
+	})
+}
+
+func TestGroupByRegion(t *testing.T) {
+	contexts := []*AwsContext{
+		&AwsContext{Target: Target{SecurityGroupID: "sg-1", Region: "eu-west-1"}},
+		&AwsContext{Target: Target{SecurityGroupID: "sg-2", Region: "us-east-1"}},
+		&AwsContext{Target: Target{SecurityGroupID: "sg-3", Region: "eu-west-1"}},
+	}
+
+	groups := GroupByRegion(contexts)
+	if len(groups) != 2 || len(groups["eu-west-1"]) != 2 || len(groups["us-east-1"]) != 1 {
+		t.Fatalf("Unexpected grouping %v", groups)
+	}
+	if groups["eu-west-1"][0] != contexts[0] || groups["eu-west-1"][1] != contexts[2] {
+		t.Errorf("Expected the targets of a region to keep their order")
+	}
+}
+
+func TestSessionCache(t *testing.T) {
+	defer os.Setenv("AWS_REGION", os.Getenv("AWS_REGION"))
+	os.Setenv("AWS_REGION", "eu-central-1")
+
+	sessions, err := NewSessionCache(nil)
+	if err != nil {
+		t.Fatalf("NewSessionCache failure: %s", err)
+	}
+	if sessions.DefaultRegion() != "eu-central-1" {
+		t.Errorf("Expected the default region to come from the environment, got %s", sessions.DefaultRegion())
+	}
+
+	role := "arn:aws:iam::123456789012:role/sgm"
+	first := sessions.EC2For(Target{SecurityGroupID: "sg-1", Region: "eu-west-1", RoleARN: role})
+	second := sessions.EC2For(Target{SecurityGroupID: "sg-2", Region: "eu-west-1", RoleARN: role})
+	if first != second {
+		t.Errorf("Expected targets sharing a region and role to share an EC2 client")
+	}
+	if *first.Config.Region != "eu-west-1" {
+		t.Errorf("Expected the EC2 client to use the region of its target, got %s", *first.Config.Region)
+	}
+
+	if sessions.EC2For(Target{SecurityGroupID: "sg-3", Region: "us-east-1", RoleARN: role}) == first {
+		t.Errorf("Expected another region to get its own EC2 client")
+	}
+	if sessions.EC2For(Target{SecurityGroupID: "sg-4", Region: "eu-west-1"}) == first {
+		t.Errorf("Expected another role to get its own EC2 client")
+	}
+}
@@ -0,0 +1,123 @@
+package awsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/metrics"
+)
+
+// Defaults for how long calls and whole reconciles may take. A call includes
+// its retries, so the call timeout leaves room for a few throttled attempts.
+const (
+	defaultCallTimeout      = 1 * time.Minute
+	defaultReconcileTimeout = 5 * time.Minute
+)
+
+// Code of the error an AWS call fails with when it ran out of its own time,
+// as opposed to being canceled by its caller.
+const ErrCodeCallTimeout = "CallTimeout"
+
+// How long talking to the AWS and Kubernetes APIs may take.
+type TimeoutConfig struct {
+	// Longest a single API call may take, retries included. 0 disables
+	// the limit.
+	Call time.Duration
+
+	// Longest a whole reconcile of every target may take. 0 disables the
+	// limit.
+	Reconcile time.Duration
+}
+
+// Load the TimeoutConfig from the environment.
+func TimeoutConfigFromEnv() (TimeoutConfig, error) {
+	config := TimeoutConfig{
+		Call:      defaultCallTimeout,
+		Reconcile: defaultReconcileTimeout,
+	}
+
+	if value := os.Getenv("AWS_SGMANAGER_CALL_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_CALL_TIMEOUT value: %s", value)
+		}
+		config.Call = timeout
+	}
+
+	if value := os.Getenv("AWS_SGMANAGER_RECONCILE_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return config, fmt.Errorf("Invalid AWS_SGMANAGER_RECONCILE_TIMEOUT value: %s", value)
+		}
+		config.Reconcile = timeout
+	}
+
+	return config, nil
+}
+
+// Give every call made through sessions handed out from now on at most
+// timeout to complete, retries included. Calls running out of time fail with
+// ErrCodeCallTimeout and are logged and counted in the metrics.
+func (c *SessionCache) LimitCallDuration(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.base.Handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "sgmanager.CallTimeout",
+		Fn:   callTimeoutHandler(timeout),
+	})
+}
+
+// Build a handler that replaces the context of a call with one ending after
+// timeout, before the call is first sent.
+func callTimeoutHandler(timeout time.Duration) func(*request.Request) {
+	return func(r *request.Request) {
+		parent := r.Context()
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		r.SetContext(ctx)
+
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			defer cancel()
+			if r.Error == nil || ctx.Err() != context.DeadlineExceeded || parent.Err() != nil {
+				return
+			}
+
+			message := fmt.Sprintf("%s didn't complete within %s", r.Operation.Name, timeout)
+			fmt.Printf("Timeout: %s\n", message)
+			metrics.Timeouts.WithLabelValues("aws", r.Operation.Name).Inc()
+			r.Error = awserr.New(ErrCodeCallTimeout, message, r.Error)
+		})
+	}
+}
+
+// Check whether err comes from running out of time, either for a single AWS
+// call or for the context it was made with.
+func IsTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	awsErr, ok := unwrapAwsError(err)
+	for ok {
+		if awsErr.Code() == ErrCodeCallTimeout || awsErr.Code() == request.ErrCodeResponseTimeout ||
+			errors.Is(awsErr.OrigErr(), context.DeadlineExceeded) {
+			return true
+		}
+
+		awsErr, ok = unwrapAwsError(awsErr.OrigErr())
+	}
+
+	return false
+}
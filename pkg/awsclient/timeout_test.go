@@ -0,0 +1,73 @@
+package awsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestTimeoutConfigFromEnv(t *testing.T) {
+	defer os.Unsetenv("AWS_SGMANAGER_CALL_TIMEOUT")
+	defer os.Unsetenv("AWS_SGMANAGER_RECONCILE_TIMEOUT")
+
+	config, err := TimeoutConfigFromEnv()
+	if err != nil || config.Call != defaultCallTimeout || config.Reconcile != defaultReconcileTimeout {
+		t.Errorf("Unexpected default config %+v, %v", config, err)
+	}
+
+	os.Setenv("AWS_SGMANAGER_CALL_TIMEOUT", "10s")
+	os.Setenv("AWS_SGMANAGER_RECONCILE_TIMEOUT", "0")
+	config, err = TimeoutConfigFromEnv()
+	if err != nil || config.Call != 10*time.Second || config.Reconcile != 0 {
+		t.Errorf("Unexpected config %+v, %v", config, err)
+	}
+
+	os.Setenv("AWS_SGMANAGER_CALL_TIMEOUT", "soon")
+	if _, err = TimeoutConfigFromEnv(); err == nil {
+		t.Errorf("Expected an invalid duration to be refused")
+	}
+}
+
+func TestCallTimeoutHandler(t *testing.T) {
+	handler := callTimeoutHandler(time.Millisecond)
+	newRequest := func(ctx context.Context) *request.Request {
+		r := &request.Request{HTTPRequest: &http.Request{}, Operation: &request.Operation{Name: "DescribeSecurityGroups"}}
+		r.SetContext(ctx)
+		handler(r)
+		<-r.Context().Done()
+		r.Error = awserr.New(request.CanceledErrorCode, "request context canceled", r.Context().Err())
+		r.Handlers.Complete.Run(r)
+		return r
+	}
+
+	r := newRequest(context.Background())
+	if !isAwsErrorCode(r.Error, ErrCodeCallTimeout) || !IsTimeout(r.Error) {
+		t.Errorf("Expected the call to time out, got %v", r.Error)
+	}
+
+	// a caller canceling the call isn't a timeout of the call
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = newRequest(ctx)
+	if !isAwsErrorCode(r.Error, request.CanceledErrorCode) || IsTimeout(r.Error) {
+		t.Errorf("Expected the call to be canceled, got %v", r.Error)
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	wrapped := fmt.Errorf("GetInboundRules error: %w",
+		awserr.New(request.CanceledErrorCode, "request context canceled", context.DeadlineExceeded))
+	if !IsTimeout(wrapped) {
+		t.Errorf("Expected a deadline inside an AWS error to be a timeout")
+	}
+	if IsTimeout(errors.New("InvalidGroup.NotFound")) || IsTimeout(nil) {
+		t.Errorf("Expected other errors not to be timeouts")
+	}
+}
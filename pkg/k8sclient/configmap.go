@@ -0,0 +1,96 @@
+package k8sclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Change the data of a ConfigMap through mutate, creating the ConfigMap if it
+// doesn't exist yet. mutate is called again with fresh data if someone else
+// updated the ConfigMap in the meantime.
+func UpdateConfigMap(ctx context.Context, clientset *kubernetes.Clientset, namespace string, name string, mutate func(data map[string]string)) error {
+	configMaps := clientset.CoreV1().ConfigMaps(namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var configMap *corev1.ConfigMap
+		err := withCallTimeout(ctx, "GetConfigMap", func(ctx context.Context) error {
+			var err error
+			configMap, err = configMaps.Get(ctx, name, metav1.GetOptions{})
+			return err
+		})
+		if apierrors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Data:       make(map[string]string),
+			}
+			mutate(configMap.Data)
+			err = withCallTimeout(ctx, "CreateConfigMap", func(ctx context.Context) error {
+				_, err := configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+				return err
+			})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(corev1.Resource("configmaps"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		mutate(configMap.Data)
+		return withCallTimeout(ctx, "UpdateConfigMap", func(ctx context.Context) error {
+			_, err := configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+			return err
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("Error updating ConfigMap %s/%s: %w", namespace, name, err)
+	}
+
+	return nil
+}
+
+// Get the value of key in a ConfigMap.
+func GetConfigMapKey(ctx context.Context, clientset *kubernetes.Clientset, namespace string, name string, key string) (string, error) {
+	var configMap *corev1.ConfigMap
+	err := withCallTimeout(ctx, "GetConfigMap", func(ctx context.Context) error {
+		var err error
+		configMap, err = clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error getting ConfigMap %s/%s: %w", namespace, name, err)
+	}
+
+	value, ok := configMap.Data[key]
+	if !ok {
+		return "", fmt.Errorf("ConfigMap %s/%s has no key %s", namespace, name, key)
+	}
+
+	return value, nil
+}
+
+// Append a line to key in a ConfigMap, keeping only the last maxLines lines.
+func AppendToConfigMap(ctx context.Context, clientset *kubernetes.Clientset, namespace string, name string, key string, line string, maxLines int) error {
+	return UpdateConfigMap(ctx, clientset, namespace, name, func(data map[string]string) {
+		lines := make([]string, 0)
+		if existing := strings.TrimSuffix(data[key], "\n"); existing != "" {
+			lines = strings.Split(existing, "\n")
+		}
+		lines = append(lines, line)
+		if len(lines) > maxLines {
+			lines = lines[len(lines)-maxLines:]
+		}
+
+		data[key] = strings.Join(lines, "\n") + "\n"
+	})
+}
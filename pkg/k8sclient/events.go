@@ -0,0 +1,56 @@
+package k8sclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Name of the component events are reported from.
+const eventSource = "aws-securitygroup-manager"
+
+// Record a Kubernetes event against the pod this instance runs in. The pod is
+// found through the POD_NAME and POD_NAMESPACE env vars, which are usually set
+// with the downward API. Without them the event is only logged.
+func RecordEvent(ctx context.Context, clientset *kubernetes.Clientset, eventType string, reason string, message string) {
+	podName := os.Getenv("POD_NAME")
+	namespace := os.Getenv("POD_NAMESPACE")
+	if podName == "" || namespace == "" {
+		fmt.Printf("Not recording %s event, POD_NAME or POD_NAMESPACE not set: %s\n", reason, message)
+		return
+	}
+
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: podName + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       podName,
+			Namespace:  namespace,
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: eventSource},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	err := withCallTimeout(ctx, "CreateEvent", func(ctx context.Context) error {
+		_, err := clientset.CoreV1().Events(namespace).Create(ctx, event, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Couldn't record %s event: %s\n", reason, err)
+	}
+}
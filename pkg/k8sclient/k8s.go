@@ -1,6 +1,7 @@
 package k8sclient
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -20,9 +21,14 @@ type NameAddressPair struct {
 }
 
 // Get the ExternalIP entry of every node in the currently connected cluster.
-func GetIPAddressList(clientset *kubernetes.Clientset) ([]*NameAddressPair, error) {
+func GetIPAddressList(ctx context.Context, clientset *kubernetes.Clientset) ([]*NameAddressPair, error) {
 	var results []*NameAddressPair
-	nodeList, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	var nodeList *corev1.NodeList
+	err := withCallTimeout(ctx, "ListNodes", func(ctx context.Context) error {
+		var err error
+		nodeList, err = clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't get node list: %w", err)
 	}
@@ -76,3 +82,19 @@ func homeDir() string {
 	}
 	return os.Getenv("USERPROFILE") // windows
 }
+
+// Get the UID of the kube-system namespace, which stays the same for as long
+// as the cluster exists and differs between clusters.
+func GetClusterUID(ctx context.Context, clientset *kubernetes.Clientset) (string, error) {
+	var namespace *corev1.Namespace
+	err := withCallTimeout(ctx, "GetNamespace", func(ctx context.Context) error {
+		var err error
+		namespace, err = clientset.CoreV1().Namespaces().Get(ctx, "kube-system", metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Couldn't get the kube-system namespace: %w", err)
+	}
+
+	return string(namespace.UID), nil
+}
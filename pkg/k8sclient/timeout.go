@@ -0,0 +1,57 @@
+package k8sclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/trigger-happy/aws-securitygroup-manager/pkg/metrics"
+)
+
+// How long a single call to the Kubernetes API may take. 0 disables the
+// limit.
+var CallTimeout time.Duration
+
+// Returned when a call to the Kubernetes API ran out of its own time, as
+// opposed to being canceled by its caller.
+type TimeoutError struct {
+	Operation string
+	Timeout   time.Duration
+	Err       error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s didn't complete within %s: %s", e.Operation, e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Check whether err comes from a Kubernetes API call running out of time.
+func IsTimeout(err error) bool {
+	var timeoutErr *TimeoutError
+	return errors.As(err, &timeoutErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Run call with a context that ends after CallTimeout. A call running out of
+// time is logged and counted in the metrics, and fails with a TimeoutError.
+func withCallTimeout(ctx context.Context, operation string, call func(ctx context.Context) error) error {
+	if CallTimeout <= 0 {
+		return call(ctx)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+	defer cancel()
+
+	err := call(callCtx)
+	if err == nil || callCtx.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+		return err
+	}
+
+	timeoutErr := &TimeoutError{Operation: operation, Timeout: CallTimeout, Err: err}
+	fmt.Printf("Timeout: %s\n", timeoutErr)
+	metrics.Timeouts.WithLabelValues("kubernetes", operation).Inc()
+	return timeoutErr
+}
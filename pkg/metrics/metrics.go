@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Address the metrics endpoint listens on unless AWS_SGMANAGER_METRICS_ADDR
+// says otherwise.
+const defaultMetricsAddr = ":9090"
+
+// Changes that were refused by the safety checks, by target and reason.
+var BlockedChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "sgmanager",
+	Name:      "blocked_changes_total",
+	Help:      "Number of rule replacements refused by the mass revocation safety checks.",
+}, []string{"target", "reason"})
+
+// Reconciles that didn't change anything because another instance is using
+// the same owner ID, by target.
+var OwnerConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "sgmanager",
+	Name:      "owner_conflicts_total",
+	Help:      "Number of reconciles stopped because another instance wrote under the same owner ID.",
+}, []string{"target"})
+
+// AWS API calls that were throttled, by operation. Throttled calls are
+// retried, so this counts attempts rather than failed calls.
+var AWSThrottledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "sgmanager",
+	Name:      "aws_throttled_requests_total",
+	Help:      "Number of AWS API call attempts that were throttled.",
+}, []string{"operation"})
+
+// Time spent waiting for the client side AWS API rate limit.
+var AWSRateLimitWait = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "sgmanager",
+	Name:      "aws_rate_limit_wait_seconds_total",
+	Help:      "Total time AWS API calls waited for the client side rate limit.",
+})
+
+// Calls and reconciles that ran out of time, by API and operation. The API
+// is "aws" or "kubernetes" for single calls and "reconcile" for whole runs.
+var Timeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "sgmanager",
+	Name:      "timeouts_total",
+	Help:      "Number of API calls and reconciles that didn't complete in time.",
+}, []string{"api", "operation"})
+
+// Heartbeats that couldn't be written, by target. An owner whose heartbeats
+// keep failing ages into expired and its rules can be removed as orphans.
+var HeartbeatFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "sgmanager",
+	Name:      "heartbeat_failures_total",
+	Help:      "Number of heartbeats that couldn't be written to a target.",
+}, []string{"target"})
+
+func init() {
+	prometheus.MustRegister(BlockedChanges)
+	prometheus.MustRegister(OwnerConflicts)
+	prometheus.MustRegister(AWSThrottledRequests)
+	prometheus.MustRegister(AWSRateLimitWait)
+	prometheus.MustRegister(Timeouts)
+	prometheus.MustRegister(HeartbeatFailures)
+}
+
+// Serve the metrics on the address from AWS_SGMANAGER_METRICS_ADDR in the
+// background. Setting it to "off" disables the endpoint.
+func ServeFromEnv() {
+	addr := os.Getenv("AWS_SGMANAGER_METRICS_ADDR")
+	if addr == "" {
+		addr = defaultMetricsAddr
+	}
+	if addr == "off" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			fmt.Printf("Metrics endpoint on %s stopped: %s\n", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,186 @@
+package schedule
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Defaults for how often reconciles run. The jitter keeps many managers
+// started at the same time from calling EC2 in lockstep.
+const (
+	defaultInterval = 60 * time.Second
+	defaultJitter   = 10 * time.Second
+)
+
+// When reconciles run, and when they may remove rules.
+type Schedule struct {
+	// Time between the end of one reconcile and the start of the next.
+	// Unused if Cron is set.
+	Interval time.Duration
+
+	// Times reconciles start at, if set.
+	Cron cron.Schedule
+
+	// Upper bound of a random delay added to every start time.
+	Jitter time.Duration
+
+	// Times during which stale rules are left in place.
+	MaintenanceWindows []*Window
+
+	random *rand.Rand
+}
+
+// A recurring period of time, starting at the times of a cron expression and
+// lasting for Duration.
+type Window struct {
+	Spec     string
+	Start    cron.Schedule
+	Duration time.Duration
+}
+
+func (w *Window) String() string {
+	return fmt.Sprintf("%s %s", w.Spec, w.Duration)
+}
+
+// Check whether t falls into one of the periods of the window. A period
+// includes its start and excludes its end.
+func (w *Window) Contains(t time.Time) bool {
+	// the first start after t - Duration is the only one whose period can
+	// still be running at t
+	start := w.Start.Next(t.Add(-w.Duration))
+	return !start.After(t)
+}
+
+// Load the Schedule from the environment. AWS_SGMANAGER_INTERVAL and
+// AWS_SGMANAGER_SCHEDULE are mutually exclusive.
+func FromEnv() (*Schedule, error) {
+	schedule := Schedule{
+		Interval: defaultInterval,
+		Jitter:   defaultJitter,
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	interval := os.Getenv("AWS_SGMANAGER_INTERVAL")
+	spec := os.Getenv("AWS_SGMANAGER_SCHEDULE")
+	if interval != "" && spec != "" {
+		return nil, fmt.Errorf("Only one of AWS_SGMANAGER_INTERVAL and AWS_SGMANAGER_SCHEDULE may be set")
+	}
+
+	if interval != "" {
+		value, err := time.ParseDuration(interval)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("Invalid AWS_SGMANAGER_INTERVAL value: %s", interval)
+		}
+		schedule.Interval = value
+	}
+
+	if spec != "" {
+		value, err := parseCron(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid AWS_SGMANAGER_SCHEDULE value %s: %w", spec, err)
+		}
+		schedule.Cron = value
+	}
+
+	if jitter := os.Getenv("AWS_SGMANAGER_JITTER"); jitter != "" {
+		value, err := time.ParseDuration(jitter)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("Invalid AWS_SGMANAGER_JITTER value: %s", jitter)
+		}
+		schedule.Jitter = value
+	}
+
+	windows, err := ParseWindows(os.Getenv("AWS_SGMANAGER_MAINTENANCE_WINDOWS"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid AWS_SGMANAGER_MAINTENANCE_WINDOWS value: %w", err)
+	}
+	schedule.MaintenanceWindows = windows
+
+	return &schedule, nil
+}
+
+// Parse a list of windows separated by semicolons. Each window is a cron
+// expression followed by a duration, for example "0 22 * * 5 60h" for the
+// weekend. The expression may start with CRON_TZ=<zone> to use a time zone
+// other than the local one.
+func ParseWindows(value string) ([]*Window, error) {
+	results := make([]*Window, 0)
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		idx := strings.LastIndex(part, " ")
+		if idx < 0 {
+			return nil, fmt.Errorf("Window %q needs a cron expression and a duration", part)
+		}
+
+		spec := strings.TrimSpace(part[:idx])
+		duration, err := time.ParseDuration(part[idx+1:])
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("Window %q has an invalid duration", part)
+		}
+
+		start, err := parseCron(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Window %q has an invalid cron expression: %w", part, err)
+		}
+
+		results = append(results, &Window{Spec: spec, Start: start, Duration: duration})
+	}
+
+	return results, nil
+}
+
+// Parse a standard cron expression, refusing ones that never match, such as
+// "0 0 30 2 *". Their next time is the zero time, which would put every
+// moment inside a window and every reconcile in the past.
+func parseCron(spec string) (cron.Schedule, error) {
+	value, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, err
+	}
+	if value.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%q never matches", spec)
+	}
+
+	return value, nil
+}
+
+// Get a random delay of up to Jitter to wait before the first reconcile, so
+// that managers restarted together don't start in lockstep either.
+func (s *Schedule) InitialDelay() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(s.random.Int63n(int64(s.Jitter)))
+}
+
+// Get the time the next reconcile should start at when the last one ended
+// at now.
+func (s *Schedule) Next(now time.Time) time.Time {
+	next := now.Add(s.Interval)
+	if s.Cron != nil {
+		next = s.Cron.Next(now)
+	}
+
+	return next.Add(s.InitialDelay())
+}
+
+// Get the maintenance window t falls into, or nil if there is none.
+func (s *Schedule) MaintenanceWindow(t time.Time) *Window {
+	for _, window := range s.MaintenanceWindows {
+		if window.Contains(t) {
+			return window
+		}
+	}
+
+	return nil
+}
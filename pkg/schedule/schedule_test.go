@@ -0,0 +1,101 @@
+package schedule
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseWindows(t *testing.T) {
+	windows, err := ParseWindows("0 22 * * 5 60h; CRON_TZ=Europe/Berlin 30 1 * * * 90m;")
+	if err != nil {
+		t.Fatalf("ParseWindows failure: %s", err)
+	}
+	if len(windows) != 2 || windows[0].Spec != "0 22 * * 5" || windows[0].Duration != 60*time.Hour ||
+		windows[1].Spec != "CRON_TZ=Europe/Berlin 30 1 * * *" || windows[1].Duration != 90*time.Minute {
+		t.Errorf("Unexpected windows %v", windows)
+	}
+
+	for _, value := range []string{"0 22 * * 5", "0 22 * * 5 -1h", "61 22 * * 5 1h", "1h", "0 0 30 2 * 1h"} {
+		if _, err = ParseWindows(value); err == nil {
+			t.Errorf("Expected %q to be refused", value)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	windows, err := ParseWindows("0 22 * * 5 60h")
+	if err != nil {
+		t.Fatalf("ParseWindows failure: %s", err)
+	}
+	weekend := windows[0]
+
+	// 2026-10-16 is a Friday
+	friday := time.Date(2026, 10, 16, 22, 0, 0, 0, time.Local)
+	cases := map[time.Time]bool{
+		friday.Add(-time.Minute):   false,
+		friday:                     true,
+		friday.Add(30 * time.Hour): true,
+		friday.Add(60*time.Hour - time.Nanosecond): true,
+		friday.Add(60 * time.Hour):                 false,
+		friday.Add(24 * 5 * time.Hour):             false,
+	}
+	for when, expected := range cases {
+		if weekend.Contains(when) != expected {
+			t.Errorf("Expected Contains(%s) to be %t", when, expected)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 34, 56, 0, time.UTC)
+	schedule := Schedule{Interval: time.Minute, Jitter: 10 * time.Second, random: rand.New(rand.NewSource(1))}
+	for i := 0; i < 100; i++ {
+		next := schedule.Next(now)
+		if next.Before(now.Add(time.Minute)) || !next.Before(now.Add(70*time.Second)) {
+			t.Fatalf("Expected the next run within the jitter after the interval, got %s", next)
+		}
+		if delay := schedule.InitialDelay(); delay < 0 || delay >= 10*time.Second {
+			t.Fatalf("Expected the initial delay within the jitter, got %s", delay)
+		}
+	}
+
+	defer os.Unsetenv("AWS_SGMANAGER_SCHEDULE")
+	defer os.Unsetenv("AWS_SGMANAGER_JITTER")
+	os.Setenv("AWS_SGMANAGER_SCHEDULE", "*/15 * * * *")
+	os.Setenv("AWS_SGMANAGER_JITTER", "0s")
+	cronSchedule, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv failure: %s", err)
+	}
+	if delay := cronSchedule.InitialDelay(); delay != 0 {
+		t.Errorf("Expected no initial delay without jitter, got %s", delay)
+	}
+	localNow := time.Date(2026, 10, 16, 12, 34, 56, 0, time.Local)
+	if next := cronSchedule.Next(localNow); !next.Equal(time.Date(2026, 10, 16, 12, 45, 0, 0, time.Local)) {
+		t.Errorf("Expected the next run on the next quarter hour, got %s", next)
+	}
+}
+
+func TestFromEnvExclusive(t *testing.T) {
+	defer os.Unsetenv("AWS_SGMANAGER_SCHEDULE")
+	defer os.Unsetenv("AWS_SGMANAGER_INTERVAL")
+
+	schedule, err := FromEnv()
+	if err != nil || schedule.Interval != defaultInterval || schedule.Jitter != defaultJitter || schedule.Cron != nil {
+		t.Errorf("Unexpected default schedule %+v, %v", schedule, err)
+	}
+
+	os.Setenv("AWS_SGMANAGER_SCHEDULE", "@hourly")
+	os.Setenv("AWS_SGMANAGER_INTERVAL", "5m")
+	if _, err = FromEnv(); err == nil {
+		t.Errorf("Expected setting both an interval and a schedule to be refused")
+	}
+
+	os.Unsetenv("AWS_SGMANAGER_INTERVAL")
+	os.Setenv("AWS_SGMANAGER_SCHEDULE", "0 0 30 2 *")
+	if _, err = FromEnv(); err == nil {
+		t.Errorf("Expected a schedule that never matches to be refused")
+	}
+}